@@ -0,0 +1,600 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiPrefix is the root of the versioned API. The original routes (/add,
+// /remove, /pause, ...) stay as aliases of it.
+const apiPrefix = "/api/v1"
+
+// entryService makes the changes to entries shared by the versioned API and
+// the original routes: it stores them, keeps the schedule in step and
+// records them in the audit log.
+type entryService struct {
+	store     *CronStore
+	scheduler *Scheduler
+	audit     *AuditLog
+}
+
+func (s *entryService) create(r *http.Request, entry CronEntry) error {
+	if err := validateEntry(entry); err != nil {
+		return errInvalidEntry(err)
+	}
+	if err := s.store.Add(entry); err != nil {
+		return err
+	}
+	if entry.State != "paused" {
+		s.scheduler.Schedule(entry)
+	}
+	s.audit.RecordRequest(r, actionAdd, entry.Name, nil, &entry)
+	return nil
+}
+
+func (s *entryService) update(r *http.Request, entry CronEntry) error {
+	if err := validateEntry(entry); err != nil {
+		return errInvalidEntry(err)
+	}
+	before, err := s.store.Update(entry)
+	if err != nil {
+		return err
+	}
+	if entry.State == "paused" {
+		s.scheduler.Unschedule(entry.Name)
+	} else {
+		s.scheduler.Reschedule(entry)
+	}
+	s.audit.RecordRequest(r, actionUpdate, entry.Name, before, &entry)
+	return nil
+}
+
+func (s *entryService) remove(r *http.Request, name string) error {
+	before, _ := s.store.Get(name)
+	if err := s.store.Remove(name); err != nil {
+		return err
+	}
+	s.scheduler.Unschedule(name)
+	s.audit.RecordRequest(r, actionRemove, name, before, nil)
+	return nil
+}
+
+func (s *entryService) pause(r *http.Request, name string) (*CronEntry, error) {
+	before, _ := s.store.Get(name)
+	entry, err := s.store.SetState(name, "paused")
+	if err != nil {
+		return nil, err
+	}
+	s.scheduler.Unschedule(name)
+	s.audit.RecordRequest(r, actionPause, name, before, entry)
+	return entry, nil
+}
+
+func (s *entryService) resume(r *http.Request, name string) (*CronEntry, error) {
+	before, _ := s.store.Get(name)
+	entry, err := s.store.SetState(name, "active")
+	if err != nil {
+		return nil, err
+	}
+	s.scheduler.Schedule(*entry)
+	s.audit.RecordRequest(r, actionResume, name, before, entry)
+	return entry, nil
+}
+
+// run starts the entry now, whether or not it is paused, and returns the
+// run id.
+func (s *entryService) run(r *http.Request, name string) (string, error) {
+	entry, err := s.store.Get(name)
+	if err != nil {
+		return "", err
+	}
+	runID, err := s.scheduler.Run(*entry)
+	if err != nil {
+		return "", err
+	}
+	s.audit.Record(AuditEntry{
+		Action:     auditRun,
+		Name:       name,
+		RunID:      runID,
+		Caller:     requestCaller(r),
+		RemoteAddr: requestAddr(r),
+		Source:     r.URL.Path,
+	})
+	return runID, nil
+}
+
+// kill cancels a run in progress.
+func (s *entryService) kill(r *http.Request, id string) (*Run, error) {
+	run, err := s.scheduler.Kill(id)
+	if err != nil {
+		return nil, err
+	}
+	s.audit.Record(AuditEntry{
+		Action:     auditKill,
+		Name:       run.Name,
+		RunID:      run.ID,
+		Caller:     requestCaller(r),
+		RemoteAddr: requestAddr(r),
+		Source:     r.URL.Path,
+	})
+	return run, nil
+}
+
+// apply brings the entries in line with desired, keeps the schedule in
+// step and audits every change. The plan it returns has secrets masked.
+func (s *entryService) apply(r *http.Request, desired []CronEntry, prune, dryRun bool) (*ApplyResult, error) {
+	result, err := s.store.Apply(desired, prune, dryRun)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Applied {
+		for _, change := range result.Plan {
+			switch change.Action {
+			case actionRemove, actionPause:
+				s.scheduler.Unschedule(change.Name)
+			default:
+				s.scheduler.Reschedule(*change.After)
+			}
+			s.audit.RecordRequest(r, change.Action, change.Name, change.Before, change.After)
+		}
+	}
+	for i := range result.Plan {
+		if change := result.Plan[i]; change.Before != nil {
+			before := redactEntry(*change.Before)
+			result.Plan[i].Before = &before
+		}
+		if change := result.Plan[i]; change.After != nil {
+			after := redactEntry(*change.After)
+			result.Plan[i].After = &after
+		}
+	}
+	return result, nil
+}
+
+// exported returns the entries to export, with their secrets masked unless
+// reveal is set. Only admins may see them.
+func (s *entryService) exported(r *http.Request, reveal string) ([]CronEntry, error) {
+	show := false
+	if reveal != "" {
+		var err error
+		if show, err = strconv.ParseBool(reveal); err != nil {
+			return nil, errInvalidQuery("reveal must be true or false")
+		}
+	}
+	if show && !isAdmin(r) {
+		return nil, errForbidden("revealing secrets needs an admin token")
+	}
+
+	entries := s.store.List()
+	if !show {
+		for i := range entries {
+			entries[i] = redactEntry(entries[i])
+		}
+	}
+	return entries, nil
+}
+
+// historyQuery reads the filters of a history request.
+func historyQuery(values url.Values) (HistoryQuery, error) {
+	query := HistoryQuery{
+		Name:   values.Get("name"),
+		Status: strings.ToUpper(values.Get("status")),
+		Limit:  10,
+		Order:  strings.ToLower(values.Get("order")),
+	}
+	if limitStr := values.Get("limit"); limitStr != "" {
+		if n, err := strconv.Atoi(limitStr); err == nil && n > 0 {
+			query.Limit = n
+		}
+	}
+	if query.Order == "" {
+		query.Order = "asc"
+	}
+	if query.Order != "asc" && query.Order != "desc" {
+		return query, errInvalidQuery("order must be asc or desc")
+	}
+	var err error
+	if query.Since, query.Until, err = timeBounds(values); err != nil {
+		return query, err
+	}
+	if cursor := values.Get("cursor"); cursor != "" {
+		n, err := strconv.ParseInt(cursor, 10, 64)
+		if err != nil || n < 1 {
+			return query, errInvalidQuery("cursor must be a history entry id")
+		}
+		query.Cursor = n
+	}
+	return query, nil
+}
+
+// auditQuery reads the filters of an audit request.
+func auditQuery(values url.Values) (AuditQuery, error) {
+	query := AuditQuery{
+		Name:   values.Get("name"),
+		Action: values.Get("action"),
+		Caller: values.Get("caller"),
+		Limit:  50,
+		Order:  strings.ToLower(values.Get("order")),
+	}
+	if limitStr := values.Get("limit"); limitStr != "" {
+		if n, err := strconv.Atoi(limitStr); err == nil && n > 0 {
+			query.Limit = n
+		}
+	}
+	if query.Order == "" {
+		query.Order = "desc"
+	}
+	if query.Order != "asc" && query.Order != "desc" {
+		return query, errInvalidQuery("order must be asc or desc")
+	}
+	var err error
+	query.Since, query.Until, err = timeBounds(values)
+	return query, err
+}
+
+// timeBounds reads the since and until parameters.
+func timeBounds(values url.Values) (since, until time.Time, err error) {
+	if value := values.Get("since"); value != "" {
+		if since, err = parseTimeBound(value); err != nil {
+			return since, until, errInvalidQuery(err.Error())
+		}
+	}
+	if value := values.Get("until"); value != "" {
+		if until, err = parseTimeBound(value); err != nil {
+			return since, until, errInvalidQuery(err.Error())
+		}
+	}
+	return since, until, nil
+}
+
+// entryStats returns the stats of one entry, or of all of them when name is
+// empty, over the window parameter.
+func entryStats(store *CronStore, values url.Values) ([]EntryStats, error) {
+	name := values.Get("name")
+	var since time.Time
+	if window := values.Get("window"); window != "" {
+		t, err := parseTimeBound(window)
+		if err != nil {
+			return nil, errInvalidQuery(err.Error())
+		}
+		since = t
+	}
+	stats := store.Stats(name, since)
+	if name != "" && len(stats) == 0 {
+		return nil, errEntryNotFound(name)
+	}
+	return stats, nil
+}
+
+// historyPage is a page of history; NextCursor fetches the next one.
+type historyPage struct {
+	History    []HistoryEntry `json:"history"`
+	NextCursor int64          `json:"nextCursor,omitempty"`
+}
+
+// exportView is an export: the rendered file and what it could not keep.
+type exportView struct {
+	Format   string   `json:"format"`
+	Content  string   `json:"content"`
+	Warnings []string `json:"warnings"`
+}
+
+// graphView is the dependency graph: every entry and the edges between them.
+type graphView struct {
+	Nodes []graphNode `json:"nodes"`
+	Edges []chainEdge `json:"edges"`
+}
+
+// graphNode is an entry of the dependency graph.
+type graphNode struct {
+	Name     string `json:"name"`
+	Schedule string `json:"schedule,omitempty"`
+	State    string `json:"state"`
+}
+
+// applyRequest is the body of an apply call.
+type applyRequest struct {
+	Entries []CronEntry `json:"entries"`
+	Prune   bool        `json:"prune,omitempty"`
+	DryRun  bool        `json:"dryRun,omitempty"`
+}
+
+// registerAPI adds the routes of the versioned API to mux. Entries are
+// read and written as JSON; PATCH takes a JSON merge patch (RFC 7386).
+func registerAPI(mux *http.ServeMux, entries *entryService) {
+	store := entries.store
+
+	mux.HandleFunc("GET "+apiPrefix+"/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(openAPIDocument))
+	})
+
+	mux.HandleFunc("GET "+apiPrefix+"/entries", func(w http.ResponseWriter, r *http.Request) {
+		summaries := store.Summaries()
+		list := store.List()
+		views := make([]entryView, len(list))
+		for i, e := range list {
+			views[i] = entryView{CronEntry: redactEntry(e), EntrySummary: summaries[e.Name]}
+		}
+		httpJSON(w, http.StatusOK, views)
+	})
+
+	mux.HandleFunc("POST "+apiPrefix+"/entries", func(w http.ResponseWriter, r *http.Request) {
+		var entry CronEntry
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&entry); err != nil {
+			httpError(w, http.StatusBadRequest, "invalid entry: "+err.Error())
+			return
+		}
+		if entry.State == "" {
+			entry.State = "active"
+		}
+		if err := entries.create(r, entry); err != nil {
+			httpError(w, errorStatus(err, http.StatusConflict), err.Error())
+			return
+		}
+		w.Header().Set("Location", apiPrefix+"/entries/"+url.PathEscape(entry.Name))
+		httpJSON(w, http.StatusCreated, redactEntry(entry))
+	})
+
+	mux.HandleFunc("GET "+apiPrefix+"/entries/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		entry, err := store.Get(name)
+		if err != nil {
+			httpError(w, errorStatus(err, http.StatusNotFound), err.Error())
+			return
+		}
+		httpJSON(w, http.StatusOK, entryView{CronEntry: redactEntry(*entry), EntrySummary: store.Summaries()[name]})
+	})
+
+	mux.HandleFunc("PATCH "+apiPrefix+"/entries/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		current, err := store.Get(name)
+		if err != nil {
+			httpError(w, errorStatus(err, http.StatusNotFound), err.Error())
+			return
+		}
+		var patch map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			httpError(w, http.StatusBadRequest, "invalid patch: "+err.Error())
+			return
+		}
+
+		entry, err := patchEntry(*current, patch)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if entry.Name != name {
+			httpError(w, http.StatusBadRequest, "name cannot be changed")
+			return
+		}
+		if err := entries.update(r, entry); err != nil {
+			httpError(w, errorStatus(err, http.StatusNotFound), err.Error())
+			return
+		}
+		httpJSON(w, http.StatusOK, redactEntry(entry))
+	})
+
+	mux.HandleFunc("DELETE "+apiPrefix+"/entries/{name}", func(w http.ResponseWriter, r *http.Request) {
+		if err := entries.remove(r, r.PathValue("name")); err != nil {
+			httpError(w, errorStatus(err, http.StatusNotFound), err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// Actions on an entry are custom methods: POST /entries/<name>:pause.
+	mux.HandleFunc("POST "+apiPrefix+"/entries/{name}", func(w http.ResponseWriter, r *http.Request) {
+		target := r.PathValue("name")
+		i := strings.LastIndex(target, ":")
+		if i < 0 {
+			httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		name, action := target[:i], target[i+1:]
+
+		if action == "run" {
+			runID, err := entries.run(r, name)
+			if err != nil {
+				httpError(w, errorStatus(err, http.StatusNotFound), err.Error())
+				return
+			}
+			httpJSON(w, http.StatusAccepted, map[string]string{"name": name, "runId": runID, "status": "QUEUED"})
+			return
+		}
+
+		var entry *CronEntry
+		var err error
+		switch action {
+		case "pause":
+			entry, err = entries.pause(r, name)
+		case "resume":
+			entry, err = entries.resume(r, name)
+		default:
+			httpError(w, http.StatusNotFound, "unknown action: "+action)
+			return
+		}
+		if err != nil {
+			httpError(w, errorStatus(err, http.StatusNotFound), err.Error())
+			return
+		}
+		httpJSON(w, http.StatusOK, redactEntry(*entry))
+	})
+
+	mux.HandleFunc("GET "+apiPrefix+"/history", func(w http.ResponseWriter, r *http.Request) {
+		query, err := historyQuery(r.URL.Query())
+		if err != nil {
+			httpError(w, errorStatus(err, http.StatusBadRequest), err.Error())
+			return
+		}
+		history, more := store.QueryHistory(query)
+		page := historyPage{History: history}
+		if page.History == nil {
+			page.History = []HistoryEntry{}
+		}
+		if more && len(history) > 0 {
+			page.NextCursor = history[len(history)-1].ID
+		}
+		httpJSON(w, http.StatusOK, page)
+	})
+
+	mux.HandleFunc("GET "+apiPrefix+"/stats", func(w http.ResponseWriter, r *http.Request) {
+		stats, err := entryStats(store, r.URL.Query())
+		if err != nil {
+			httpError(w, errorStatus(err, http.StatusNotFound), err.Error())
+			return
+		}
+		httpJSON(w, http.StatusOK, stats)
+	})
+
+	mux.HandleFunc("GET "+apiPrefix+"/running", func(w http.ResponseWriter, r *http.Request) {
+		httpJSON(w, http.StatusOK, entries.scheduler.Running())
+	})
+
+	mux.HandleFunc("POST "+apiPrefix+"/kill", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Run string `json:"run"`
+		}
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&body); err != nil {
+			httpError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+			return
+		}
+		if body.Run == "" {
+			httpError(w, http.StatusBadRequest, "run is required")
+			return
+		}
+		run, err := entries.kill(r, body.Run)
+		if err != nil {
+			httpError(w, errorStatus(err, http.StatusNotFound), err.Error())
+			return
+		}
+		httpJSON(w, http.StatusOK, map[string]string{"id": run.ID, "name": run.Name, "status": "CANCELLING"})
+	})
+
+	mux.HandleFunc("POST "+apiPrefix+"/apply", func(w http.ResponseWriter, r *http.Request) {
+		var body applyRequest
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&body); err != nil {
+			httpError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+			return
+		}
+		result, err := entries.apply(r, body.Entries, body.Prune, body.DryRun)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		httpJSON(w, http.StatusOK, result)
+	})
+
+	mux.HandleFunc("GET "+apiPrefix+"/audit", func(w http.ResponseWriter, r *http.Request) {
+		query, err := auditQuery(r.URL.Query())
+		if err != nil {
+			httpError(w, errorStatus(err, http.StatusBadRequest), err.Error())
+			return
+		}
+		records, err := entries.audit.Query(query)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if records == nil {
+			records = []AuditEntry{}
+		}
+		httpJSON(w, http.StatusOK, records)
+	})
+
+	mux.HandleFunc("GET "+apiPrefix+"/export", func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "json"
+		}
+		list, err := entries.exported(r, r.URL.Query().Get("reveal"))
+		if err != nil {
+			httpError(w, errorStatus(err, http.StatusBadRequest), err.Error())
+			return
+		}
+		data, warnings, err := renderEntries(list, format)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if warnings == nil {
+			warnings = []string{}
+		}
+		httpJSON(w, http.StatusOK, exportView{Format: format, Content: string(data), Warnings: warnings})
+	})
+
+	mux.HandleFunc("GET "+apiPrefix+"/graph", func(w http.ResponseWriter, r *http.Request) {
+		list := store.List()
+		nodes := make([]graphNode, len(list))
+		for i, e := range list {
+			nodes[i] = graphNode{Name: e.Name, Schedule: describeSchedule(e), State: e.State}
+		}
+		edges := chainEdges(list)
+		if edges == nil {
+			edges = []chainEdge{}
+		}
+		httpJSON(w, http.StatusOK, graphView{Nodes: nodes, Edges: edges})
+	})
+}
+
+// patchEntry applies a JSON merge patch to the entry. Secrets sent back
+// masked, as they are read from the API, keep their stored value.
+func patchEntry(entry CronEntry, patch map[string]interface{}) (CronEntry, error) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return entry, err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return entry, err
+	}
+
+	data, err = json.Marshal(mergePatch(doc, patch))
+	if err != nil {
+		return entry, err
+	}
+	var result CronEntry
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&result); err != nil {
+		return entry, fmt.Errorf("invalid patch: %v", err)
+	}
+
+	result = restoreSecrets(result, entry)
+	if secret := maskedSecret(result); secret != "" {
+		return entry, fmt.Errorf("%s is masked and has no stored value", secret)
+	}
+	return result, nil
+}
+
+// mergePatch merges patch into target: null removes a member, objects merge
+// recursively and any other value replaces the member.
+func mergePatch(target, patch map[string]interface{}) map[string]interface{} {
+	if target == nil {
+		target = make(map[string]interface{})
+	}
+	for key, value := range patch {
+		switch value := value.(type) {
+		case nil:
+			delete(target, key)
+		case map[string]interface{}:
+			current, _ := target[key].(map[string]interface{})
+			target[key] = mergePatch(current, value)
+		default:
+			target[key] = value
+		}
+	}
+	return target
+}
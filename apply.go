@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	actionAdd    = "add"
+	actionUpdate = "update"
+	actionRemove = "remove"
+	actionPause  = "pause"
+	actionResume = "resume"
+)
+
+// PlanChange is one change needed to bring the entries in line with a
+// manifest.
+type PlanChange struct {
+	Action string     `json:"action"`
+	Name   string     `json:"name"`
+	Fields []string   `json:"fields,omitempty"`
+	Before *CronEntry `json:"before,omitempty"`
+	After  *CronEntry `json:"after,omitempty"`
+}
+
+type ApplyResult struct {
+	Plan    []PlanChange `json:"plan"`
+	Applied bool         `json:"applied"`
+}
+
+// Apply brings the entries in line with desired. Entries missing from
+// desired are removed only when prune is set. With dryRun the plan is
+// returned without changing anything; otherwise every change is saved at
+// once, or none is.
+func (s *CronStore) Apply(desired []CronEntry, prune, dryRun bool) (*ApplyResult, error) {
+	seen := make(map[string]bool)
+	for i := range desired {
+		if desired[i].State == "" {
+			desired[i].State = "active"
+		}
+		if err := validateEntry(desired[i]); err != nil {
+			return nil, fmt.Errorf("entry %q: %v", desired[i].Name, err)
+		}
+		if seen[desired[i].Name] {
+			return nil, fmt.Errorf("entry %q is defined more than once", desired[i].Name)
+		}
+		seen[desired[i].Name] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := make(map[string]CronEntry, len(s.entries))
+	for _, e := range s.entries {
+		current[e.Name] = e
+	}
+	// Manifests made from exports carry masked secrets; keep the stored ones
+	for i := range desired {
+		if before, ok := current[desired[i].Name]; ok {
+			desired[i] = restoreSecrets(desired[i], before)
+		}
+		if secret := maskedSecret(desired[i]); secret != "" {
+			return nil, fmt.Errorf("entry %q: %s is masked and has no stored value", desired[i].Name, secret)
+		}
+	}
+
+	result := &ApplyResult{Plan: []PlanChange{}}
+	for i := range desired {
+		after := desired[i]
+		before, ok := current[after.Name]
+		if !ok {
+			result.Plan = append(result.Plan, PlanChange{Action: actionAdd, Name: after.Name, After: &after})
+			continue
+		}
+		if reflect.DeepEqual(before, after) {
+			continue
+		}
+
+		fields := changedFields(before, after)
+		action := actionUpdate
+		if len(fields) == 1 && fields[0] == "state" {
+			action = actionResume
+			if after.State == "paused" {
+				action = actionPause
+			}
+		}
+		b := before
+		result.Plan = append(result.Plan, PlanChange{Action: action, Name: after.Name, Fields: fields, Before: &b, After: &after})
+	}
+
+	if prune {
+		for _, e := range s.entries {
+			if !seen[e.Name] {
+				b := e
+				result.Plan = append(result.Plan, PlanChange{Action: actionRemove, Name: e.Name, Before: &b})
+			}
+		}
+	}
+
+	if dryRun || len(result.Plan) == 0 {
+		return result, nil
+	}
+
+	previous := s.entries
+	next := make([]CronEntry, 0, len(s.entries)+len(desired))
+	for _, e := range s.entries {
+		if seen[e.Name] || !prune {
+			next = append(next, e)
+		}
+	}
+	for _, change := range result.Plan {
+		switch change.Action {
+		case actionAdd:
+			next = append(next, *change.After)
+		case actionUpdate, actionPause, actionResume:
+			for i := range next {
+				if next[i].Name == change.Name {
+					next[i] = *change.After
+				}
+			}
+		}
+	}
+
+	if err := validateGraph(next); err != nil {
+		return nil, err
+	}
+
+	s.entries = next
+	if err := s.save(); err != nil {
+		s.entries = previous
+		return nil, err
+	}
+	result.Applied = true
+	return result, nil
+}
+
+// changedFields lists the JSON fields that differ between two entries.
+func changedFields(before, after CronEntry) []string {
+	var b, a map[string]interface{}
+	bData, _ := json.Marshal(before)
+	aData, _ := json.Marshal(after)
+	json.Unmarshal(bData, &b)
+	json.Unmarshal(aData, &a)
+
+	var fields []string
+	for key, value := range a {
+		if !reflect.DeepEqual(b[key], value) {
+			fields = append(fields, key)
+		}
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			fields = append(fields, key)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// loadManifest reads entries from a JSON or YAML manifest. The manifest is
+// either a list of entries or an object with an "entries" list, using the
+// same field names as .cron.json.
+func loadManifest(path string) ([]CronEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(data, filepath.Ext(path))
+}
+
+func parseManifest(data []byte, ext string) ([]CronEntry, error) {
+	var raw interface{}
+	switch strings.ToLower(ext) {
+	case ".json":
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, fmt.Errorf("invalid JSON manifest: %v", err)
+		}
+	default:
+		if err := yaml.Unmarshal(data, &raw); err != nil {
+			return nil, fmt.Errorf("invalid YAML manifest: %v", err)
+		}
+	}
+
+	if doc, ok := raw.(map[string]interface{}); ok {
+		for key := range doc {
+			if key != "entries" {
+				return nil, fmt.Errorf("invalid manifest: unknown field %q", key)
+			}
+		}
+		raw = doc["entries"]
+	}
+	if raw == nil {
+		return []CronEntry{}, nil
+	}
+
+	// Round-trip through JSON so YAML manifests use the JSON field names
+	normalized, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+	// Misspelled fields are errors rather than settings silently dropped
+	var entries []CronEntry
+	decoder := json.NewDecoder(bytes.NewReader(normalized))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&entries); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %s", strings.TrimPrefix(err.Error(), "json: "))
+	}
+	return entries, nil
+}
+
+// printPlan writes a one line per change summary of the plan.
+func printPlan(w io.Writer, plan []PlanChange) {
+	if len(plan) == 0 {
+		fmt.Fprintln(w, "no changes")
+		return
+	}
+	symbols := map[string]string{
+		actionAdd:    "+",
+		actionUpdate: "~",
+		actionRemove: "-",
+		actionPause:  "||",
+		actionResume: ">",
+	}
+	for _, change := range plan {
+		line := fmt.Sprintf("%s %s %s", symbols[change.Action], change.Action, change.Name)
+		if change.Action == actionUpdate {
+			line += " (" + strings.Join(change.Fields, ", ") + ")"
+		}
+		fmt.Fprintln(w, line)
+	}
+}
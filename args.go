@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// argsData is what templated args are expanded from, e.g.
+// {{.ScheduledAt | date "2006-01-02"}}.
+type argsData struct {
+	Name           string
+	RunID          string
+	ScheduledAt    time.Time
+	FiredAt        time.Time
+	Attempt        int
+	Trigger        string
+	PreviousStatus string
+	UpstreamRunID  string
+	Files          []string
+	Input          string
+	Query          string
+}
+
+var argsFuncs = template.FuncMap{
+	"date": func(layout string, t time.Time) string {
+		return t.Format(layout)
+	},
+	"utc": func(t time.Time) time.Time {
+		return t.UTC()
+	},
+	"add": func(expr string, t time.Time) (time.Time, error) {
+		d, err := parseInterval(strings.TrimPrefix(expr, "-"))
+		if err != nil {
+			return t, err
+		}
+		if strings.HasPrefix(expr, "-") {
+			d = -d
+		}
+		return t.Add(d), nil
+	},
+}
+
+func newArgsData(name string, rc runContext) argsData {
+	data := argsData{
+		Name:           name,
+		RunID:          rc.runID,
+		ScheduledAt:    rc.planned,
+		FiredAt:        rc.fired,
+		Attempt:        rc.attempt,
+		Trigger:        rc.source,
+		PreviousStatus: rc.previous,
+		UpstreamRunID:  rc.upstream,
+		Files:          rc.files,
+	}
+	if rc.hook != nil {
+		data.Input = rc.hook.Body
+		data.Query = rc.hook.Query
+	}
+	return data
+}
+
+// expandArgs expands the templates in args.
+func expandArgs(args []string, data argsData) ([]string, error) {
+	expanded := make([]string, len(args))
+	for i, arg := range args {
+		if !strings.Contains(arg, "{{") {
+			expanded[i] = arg
+			continue
+		}
+		tmpl, err := template.New("arg").Funcs(argsFuncs).Option("missingkey=error").Parse(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid args template %q: %v", arg, err)
+		}
+		var out bytes.Buffer
+		if err := tmpl.Execute(&out, data); err != nil {
+			return nil, fmt.Errorf("invalid args template %q: %v", arg, err)
+		}
+		expanded[i] = out.String()
+	}
+	return expanded, nil
+}
+
+// validateArgs checks that the templates in args parse and expand against
+// a sample run.
+func validateArgs(args []string) error {
+	now := time.Now()
+	_, err := expandArgs(args, argsData{Name: "validate", ScheduledAt: now, FiredAt: now, Attempt: 1, Trigger: sourceSchedule})
+	return err
+}
+
+func hasTemplates(args []string) bool {
+	for _, arg := range args {
+		if strings.Contains(arg, "{{") {
+			return true
+		}
+	}
+	return false
+}
+
+// entryCommand returns the command line of an attempt: run as is, or args
+// expanded and quoted for the shell.
+func entryCommand(entry CronEntry, rc runContext) (string, error) {
+	if len(entry.Args) == 0 {
+		return entry.Run, nil
+	}
+	args, err := expandArgs(entry.Args, newArgsData(entry.Name, rc))
+	if err != nil {
+		return "", err
+	}
+	return joinArgs(args), nil
+}
+
+// joinArgs quotes each argument so the shell passes it through unchanged.
+func joinArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
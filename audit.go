@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	auditKill     = "kill"
+	auditRun      = "run"
+	auditShutdown = "shutdown"
+	auditTokenAdd = "token-create"
+	auditTokenDel = "token-revoke"
+)
+
+// AuditEntry records a change to the scheduler: who made it, from where,
+// and the entry before and after. Source is the API path of the call, or
+// what else made the change.
+type AuditEntry struct {
+	ID         int64      `json:"id"`
+	Timestamp  string     `json:"timestamp"`
+	Action     string     `json:"action"`
+	Name       string     `json:"name,omitempty"`
+	RunID      string     `json:"runId,omitempty"`
+	Caller     string     `json:"caller"`
+	RemoteAddr string     `json:"remoteAddr,omitempty"`
+	Source     string     `json:"source"`
+	Before     *CronEntry `json:"before,omitempty"`
+	After      *CronEntry `json:"after,omitempty"`
+}
+
+type AuditQuery struct {
+	Name   string
+	Action string
+	Caller string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+	Order  string
+}
+
+// AuditLog appends audit entries, one JSON object per line, to
+// .cron-audit.jsonl. Entries are never rewritten; an entry's id is its
+// line number.
+type AuditLog struct {
+	mu   sync.Mutex
+	path string
+	// events receives the changes to entries as they are recorded
+	events *EventBus
+}
+
+func NewAuditLog(dir string) *AuditLog {
+	return &AuditLog{path: filepath.Join(dir, ".cron-audit.jsonl")}
+}
+
+// Record appends the entry and publishes changes to entries as events. Env
+// secrets and hook secrets are masked. A failure to write is logged, it
+// never fails the change itself.
+func (a *AuditLog) Record(entry AuditEntry) {
+	if a == nil {
+		return
+	}
+	entry.Timestamp = time.Now().UTC().Format(time.RFC3339Nano)
+	if entry.Before != nil {
+		before := redactEntry(*entry.Before)
+		entry.Before = &before
+	}
+	if entry.After != nil {
+		after := redactEntry(*entry.After)
+		entry.After = &after
+	}
+
+	a.mu.Lock()
+	if err := a.append(entry); err != nil {
+		fmt.Fprintf(defaultStderr, "cron: failed to write audit log: %v\n", err)
+	}
+	a.mu.Unlock()
+
+	if eventType, ok := entryEvents[entry.Action]; ok {
+		changed := entry.After
+		if changed == nil {
+			changed = entry.Before
+		}
+		a.events.Publish(Event{Type: eventType, Name: entry.Name, Source: entry.Source, Caller: entry.Caller, Entry: changed})
+	}
+}
+
+func (a *AuditLog) append(entry AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+// RecordRequest records a change made through the API.
+func (a *AuditLog) RecordRequest(r *http.Request, action, name string, before, after *CronEntry) {
+	a.Record(AuditEntry{
+		Action:     action,
+		Name:       name,
+		Caller:     requestCaller(r),
+		RemoteAddr: requestAddr(r),
+		Source:     r.URL.Path,
+		Before:     before,
+		After:      after,
+	})
+}
+
+// Query returns the entries matching q, newest first unless q.Order is
+// asc.
+func (a *AuditLog) Query(q AuditQuery) ([]AuditEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	result := []AuditEntry{}
+	file, err := os.Open(a.path)
+	if os.IsNotExist(err) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var id int64
+	for scanner.Scan() {
+		id++
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		entry.ID = id
+		if q.Name != "" && entry.Name != q.Name {
+			continue
+		}
+		if q.Action != "" && entry.Action != q.Action {
+			continue
+		}
+		if q.Caller != "" && entry.Caller != q.Caller {
+			continue
+		}
+		if !q.Since.IsZero() || !q.Until.IsZero() {
+			t, err := time.Parse(time.RFC3339Nano, entry.Timestamp)
+			if err != nil || (!q.Since.IsZero() && t.Before(q.Since)) || (!q.Until.IsZero() && t.After(q.Until)) {
+				continue
+			}
+		}
+		result = append(result, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if q.Order != "asc" {
+		sort.Slice(result, func(i, j int) bool { return result[i].ID > result[j].ID })
+	}
+	if q.Limit > 0 && len(result) > q.Limit {
+		result = result[:q.Limit]
+	}
+	return result, nil
+}
+
+type callerKey struct{}
+
+// withCaller tags the request with who made it.
+func withCaller(r *http.Request, caller string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), callerKey{}, caller))
+}
+
+// requestCaller returns who made the request: a token, a client
+// certificate, the Unix socket, or anonymous when the API is open.
+func requestCaller(r *http.Request) string {
+	if caller, ok := r.Context().Value(callerKey{}).(string); ok {
+		return caller
+	}
+	return "anonymous"
+}
+
+// requestAddr returns the remote address of a request made over TCP.
+func requestAddr(r *http.Request) string {
+	if fromSocket(r) {
+		return ""
+	}
+	return r.RemoteAddr
+}
+
+// localCaller names the user running a local command.
+func localCaller() string {
+	if u, err := user.Current(); err == nil {
+		return "user " + u.Username
+	}
+	return fmt.Sprintf("uid %d", os.Getuid())
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	roleRead  = "read"
+	roleAdmin = "admin"
+
+	// tokenEnv and tokenFileEnv are where the client looks for its token,
+	// before the config file
+	tokenEnv     = "AUX4_CRON_TOKEN"
+	tokenFileEnv = "AUX4_CRON_TOKEN_FILE"
+
+	tokenPrefix = "cron_"
+)
+
+// APIToken is a token of the management API. Only the SHA-256 hash of the
+// token is stored.
+type APIToken struct {
+	Name      string `json:"name"`
+	Role      string `json:"role"`
+	Hash      string `json:"hash,omitempty"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// TokenStore holds the API tokens of a cron directory, kept in
+// .cron-tokens.json. The file is read again whenever it changes, so tokens
+// created or revoked while the scheduler runs apply right away.
+type TokenStore struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	size    int64
+	tokens  []APIToken
+}
+
+func NewTokenStore(dir string) *TokenStore {
+	return &TokenStore{path: filepath.Join(dir, ".cron-tokens.json")}
+}
+
+// refresh reads the file again if it changed since it was last read.
+func (t *TokenStore) refresh() error {
+	info, err := os.Stat(t.path)
+	if os.IsNotExist(err) {
+		t.tokens, t.modTime, t.size = nil, time.Time{}, 0
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(t.modTime) && info.Size() == t.size {
+		return nil
+	}
+
+	data, err := os.ReadFile(t.path)
+	if err != nil {
+		return err
+	}
+	var tokens []APIToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return fmt.Errorf("invalid %s: %v", filepath.Base(t.path), err)
+	}
+	t.tokens, t.modTime, t.size = tokens, info.ModTime(), info.Size()
+	return nil
+}
+
+func (t *TokenStore) save() error {
+	data, err := json.MarshalIndent(t.tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(t.path, data, 0600)
+}
+
+// Enabled reports whether any token exists; without tokens the API is open.
+func (t *TokenStore) Enabled() (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.refresh(); err != nil {
+		return false, err
+	}
+	return len(t.tokens) > 0, nil
+}
+
+// Authenticate returns the token matching secret.
+func (t *TokenStore) Authenticate(secret string) (*APIToken, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.refresh(); err != nil {
+		return nil, err
+	}
+
+	hash := hashToken(secret)
+	for _, token := range t.tokens {
+		if subtle.ConstantTimeCompare([]byte(token.Hash), []byte(hash)) == 1 {
+			result := token
+			return &result, nil
+		}
+	}
+	return nil, nil
+}
+
+// Create adds a token and returns its secret, which is not stored.
+func (t *TokenStore) Create(name, role string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("token name is required")
+	}
+	if role != roleRead && role != roleAdmin {
+		return "", fmt.Errorf("invalid role: %s (expected read or admin)", role)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.refresh(); err != nil {
+		return "", err
+	}
+	for _, token := range t.tokens {
+		if token.Name == name {
+			return "", fmt.Errorf("token %s already exists", name)
+		}
+	}
+
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	secret := tokenPrefix + hex.EncodeToString(b)
+	t.tokens = append(t.tokens, APIToken{
+		Name:      name,
+		Role:      role,
+		Hash:      hashToken(secret),
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	})
+	return secret, t.save()
+}
+
+// Revoke removes a token.
+func (t *TokenStore) Revoke(name string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.refresh(); err != nil {
+		return err
+	}
+	for i, token := range t.tokens {
+		if token.Name == name {
+			t.tokens = append(t.tokens[:i], t.tokens[i+1:]...)
+			return t.save()
+		}
+	}
+	return fmt.Errorf("token %s not found", name)
+}
+
+// List returns the tokens without their hashes.
+func (t *TokenStore) List() ([]APIToken, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.refresh(); err != nil {
+		return nil, err
+	}
+	tokens := make([]APIToken, len(t.tokens))
+	for i, token := range t.tokens {
+		token.Hash = ""
+		tokens[i] = token
+	}
+	return tokens, nil
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// publicPaths are served without a token: probes, the API description, and
+// webhooks which check their own secret.
+var publicPaths = []string{"/healthz", "/readyz", "/hooks/", apiPrefix + "/openapi.json"}
+
+// apiAuth decides who may call the API: holders of a token, once any token
+// exists, and with mutual TLS the clients presenting a certificate of the
+// client CA.
+type apiAuth struct {
+	tokens *TokenStore
+	// mtls requires every caller to be identified, by certificate or token
+	mtls bool
+	// clientRoles maps certificate names to roles; other certificates of the
+	// client CA are read-only
+	clientRoles map[string]string
+}
+
+// requireAuth guards the API. Read callers may only GET; everything else
+// needs the admin role. Calls through the Unix socket are trusted, its
+// permissions decide who connects.
+func requireAuth(auth *apiAuth, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fromSocket(r) {
+			next.ServeHTTP(w, withRole(withCaller(r, "socket"), roleAdmin))
+			return
+		}
+		for _, path := range publicPaths {
+			if r.URL.Path == path || (strings.HasSuffix(path, "/") && strings.HasPrefix(r.URL.Path, path)) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		if identity := clientIdentity(r); identity != "" {
+			role := auth.clientRoles[identity]
+			if role == "" {
+				role = roleRead
+			}
+			authorize(w, r, next, "certificate "+identity, role)
+			return
+		}
+
+		enabled, err := auth.tokens.Enabled()
+		if err != nil {
+			fmt.Fprintf(defaultStderr, "cron: failed to read tokens: %v\n", err)
+			httpError(w, http.StatusInternalServerError, "failed to read tokens")
+			return
+		}
+		if !enabled && !auth.mtls {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		var token *APIToken
+		if ok && enabled {
+			token, err = auth.tokens.Authenticate(strings.TrimSpace(secret))
+			if err != nil {
+				fmt.Fprintf(defaultStderr, "cron: failed to read tokens: %v\n", err)
+				httpError(w, http.StatusInternalServerError, "failed to read tokens")
+				return
+			}
+		}
+		if token == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="aux4-cron"`)
+			if auth.mtls {
+				httpError(w, http.StatusUnauthorized, "missing client certificate or token")
+			} else {
+				httpError(w, http.StatusUnauthorized, "missing or invalid token")
+			}
+			return
+		}
+		authorize(w, r, next, "token "+token.Name, token.Role)
+	})
+}
+
+func authorize(w http.ResponseWriter, r *http.Request, next http.Handler, caller, role string) {
+	if role != roleAdmin && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		httpError(w, http.StatusForbidden, caller+" is read-only")
+		return
+	}
+	next.ServeHTTP(w, withRole(withCaller(r, caller), role))
+}
+
+type roleKey struct{}
+
+// withRole tags the request with the role of its caller.
+func withRole(r *http.Request, role string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), roleKey{}, role))
+}
+
+// isAdmin reports whether the request comes through the Unix socket or from
+// an admin token or certificate. Calls to an open API have no role.
+func isAdmin(r *http.Request) bool {
+	role, _ := r.Context().Value(roleKey{}).(string)
+	return role == roleAdmin
+}
+
+// parseClientRoles parses "name=role" pairs separated by commas.
+func parseClientRoles(value string) (map[string]string, error) {
+	roles := make(map[string]string)
+	for _, item := range splitList(value) {
+		name, role, ok := strings.Cut(item, "=")
+		if !ok || name == "" || (role != roleRead && role != roleAdmin) {
+			return nil, fmt.Errorf("invalid client role: %s (expected name=read or name=admin)", item)
+		}
+		roles[strings.TrimSpace(name)] = role
+	}
+	return roles, nil
+}
+
+// isLoopback reports whether a bind address only accepts local connections.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// clientToken returns the token client commands send: $AUX4_CRON_TOKEN,
+// else the content of $AUX4_CRON_TOKEN_FILE, else of the token file in the
+// user's config directory (~/.config/aux4-cron/token on Linux).
+func clientToken() string {
+	if token := os.Getenv(tokenEnv); token != "" {
+		return strings.TrimSpace(token)
+	}
+	path := os.Getenv(tokenFileEnv)
+	if path == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return ""
+		}
+		path = filepath.Join(dir, "aux4-cron", "token")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	chainSuccess = "success"
+	chainFailure = "failure"
+	chainAlways  = "always"
+)
+
+const sourceChain = "chain"
+
+// chainEdge is a dependency between two entries: when From finishes with
+// an outcome matching Condition, To runs.
+type chainEdge struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Condition string `json:"condition"`
+}
+
+// parseAfter splits an after item, "name" or "name:condition", where the
+// condition is success (the default), failure or always.
+func parseAfter(item string) (string, string, error) {
+	name, condition, found := strings.Cut(item, ":")
+	if !found {
+		return name, chainSuccess, nil
+	}
+	switch condition {
+	case chainSuccess, chainFailure, chainAlways:
+		return name, condition, nil
+	}
+	return "", "", fmt.Errorf("invalid after condition: %s (expected success, failure or always)", item)
+}
+
+// chainEdges returns the dependencies declared by the entries through
+// onSuccess, onFailure and after, sorted and without duplicates.
+func chainEdges(entries []CronEntry) []chainEdge {
+	seen := make(map[chainEdge]bool)
+	var edges []chainEdge
+	add := func(edge chainEdge) {
+		if !seen[edge] {
+			seen[edge] = true
+			edges = append(edges, edge)
+		}
+	}
+
+	for _, e := range entries {
+		for _, to := range e.OnSuccess {
+			add(chainEdge{From: e.Name, To: to, Condition: chainSuccess})
+		}
+		for _, to := range e.OnFailure {
+			add(chainEdge{From: e.Name, To: to, Condition: chainFailure})
+		}
+		for _, item := range e.After {
+			if from, condition, err := parseAfter(item); err == nil {
+				add(chainEdge{From: from, To: e.Name, Condition: condition})
+			}
+		}
+	}
+
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].From != edges[j].From {
+			return edges[i].From < edges[j].From
+		}
+		if edges[i].To != edges[j].To {
+			return edges[i].To < edges[j].To
+		}
+		return edges[i].Condition < edges[j].Condition
+	})
+	return edges
+}
+
+// validateGraph checks that the dependencies between entries only refer to
+// existing entries and never form a cycle.
+func validateGraph(entries []CronEntry) error {
+	exists := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		exists[e.Name] = true
+	}
+
+	next := make(map[string][]string)
+	for _, edge := range chainEdges(entries) {
+		if !exists[edge.From] {
+			return errInvalidGraph(fmt.Sprintf("entry %s depends on unknown entry %s", edge.To, edge.From))
+		}
+		if !exists[edge.To] {
+			return errInvalidGraph(fmt.Sprintf("entry %s triggers unknown entry %s", edge.From, edge.To))
+		}
+		next[edge.From] = append(next[edge.From], edge.To)
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	var path []string
+	var visit func(name string) error
+	visit = func(name string) error {
+		state[name] = visiting
+		path = append(path, name)
+		for _, to := range next[name] {
+			switch state[to] {
+			case visiting:
+				start := 0
+				for i, n := range path {
+					if n == to {
+						start = i
+					}
+				}
+				cycle := append(append([]string{}, path[start:]...), to)
+				return errInvalidGraph("dependency cycle: " + strings.Join(cycle, " -> "))
+			case unvisited:
+				if err := visit(to); err != nil {
+					return err
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+		return nil
+	}
+
+	for _, e := range entries {
+		if state[e.Name] == unvisited {
+			if err := visit(e.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// dependents returns the names of the entries that refer to name in their
+// after, onSuccess or onFailure lists. The entries name itself triggers do
+// not depend on it.
+func dependents(entries []CronEntry, name string) []string {
+	var names []string
+	for _, e := range entries {
+		if e.Name == name {
+			continue
+		}
+		if _, changed := detach(e, name); changed {
+			names = append(names, e.Name)
+		}
+	}
+	return names
+}
+
+// detach returns the entry without its references to name, and whether it
+// had any.
+func detach(e CronEntry, name string) (CronEntry, bool) {
+	changed := false
+	without := func(items []string, match func(string) bool) []string {
+		var kept []string
+		for _, item := range items {
+			if match(item) {
+				changed = true
+				continue
+			}
+			kept = append(kept, item)
+		}
+		return kept
+	}
+	isName := func(item string) bool { return item == name }
+	isAfter := func(item string) bool {
+		from, _, err := parseAfter(item)
+		return err == nil && from == name
+	}
+
+	e.After = without(e.After, isAfter)
+	e.OnSuccess = without(e.OnSuccess, isName)
+	e.OnFailure = without(e.OnFailure, isName)
+	return e, changed
+}
+
+// chain triggers the entries that depend on how the run of entry ended.
+// Cancelled runs trigger nothing.
+func (s *Scheduler) chain(entry CronEntry, status, runID string) {
+	if status == "CANCELLED" {
+		return
+	}
+	outcome := chainSuccess
+	if isFailureStatus(status) {
+		outcome = chainFailure
+	}
+
+	entries := s.store.List()
+	byName := make(map[string]CronEntry, len(entries))
+	for _, e := range entries {
+		byName[e.Name] = e
+	}
+
+	triggered := make(map[string]bool)
+	for _, edge := range chainEdges(entries) {
+		if edge.From != entry.Name || triggered[edge.To] {
+			continue
+		}
+		if edge.Condition != chainAlways && edge.Condition != outcome {
+			continue
+		}
+		target, ok := byName[edge.To]
+		if !ok {
+			continue
+		}
+		if target.State != "active" {
+			fmt.Fprintf(defaultStderr, "cron %s: not triggered by %s, task is paused\n", target.Name, entry.Name)
+			continue
+		}
+		triggered[edge.To] = true
+
+		delay := time.Duration(0)
+		if target.Delay != "" {
+			delay, _ = parseInterval(target.Delay)
+		}
+		req := runRequest{entry: target, planned: time.Now().Add(delay), source: sourceChain, upstream: runID}
+		if delay == 0 {
+			s.enqueue(req)
+			continue
+		}
+		time.AfterFunc(delay, func() {
+			s.mu.Lock()
+			running := s.running
+			s.mu.Unlock()
+			if !running {
+				return
+			}
+			// The task may have been removed, paused or edited during the delay.
+			current, err := s.store.Get(req.entry.Name)
+			if err != nil {
+				return
+			}
+			if current.State != "active" {
+				fmt.Fprintf(defaultStderr, "cron %s: not triggered by %s, task is paused\n", current.Name, entry.Name)
+				return
+			}
+			req.entry = *current
+			s.enqueue(req)
+		})
+	}
+}
+
+// writeGraphText writes the dependency graph as an indented tree, starting
+// from the entries nothing depends on.
+func writeGraphText(w io.Writer, entries []CronEntry) {
+	edges := chainEdges(entries)
+	byName := make(map[string]CronEntry, len(entries))
+	hasUpstream := make(map[string]bool)
+	next := make(map[string][]chainEdge)
+	for _, e := range entries {
+		byName[e.Name] = e
+	}
+	for _, edge := range edges {
+		hasUpstream[edge.To] = true
+		next[edge.From] = append(next[edge.From], edge)
+	}
+
+	var walk func(name, prefix string)
+	walk = func(name, prefix string) {
+		for _, edge := range next[name] {
+			fmt.Fprintf(w, "%s  on %s -> %s%s\n", prefix, edge.Condition, edge.To, graphDetails(byName[edge.To], false))
+			walk(edge.To, prefix+"  ")
+		}
+	}
+
+	if len(entries) == 0 {
+		fmt.Fprintln(w, "no tasks")
+		return
+	}
+	for _, e := range entries {
+		if hasUpstream[e.Name] {
+			continue
+		}
+		fmt.Fprintf(w, "%s%s\n", e.Name, graphDetails(e, true))
+		walk(e.Name, "")
+	}
+}
+
+// writeGraphDOT writes the dependency graph in Graphviz DOT format.
+func writeGraphDOT(w io.Writer, entries []CronEntry) {
+	fmt.Fprintln(w, "digraph cron {")
+	fmt.Fprintln(w, "  rankdir=LR;")
+	for _, e := range entries {
+		label := e.Name
+		if s := describeSchedule(e); s != "" {
+			label += `\n` + s
+		}
+		style := ""
+		if e.State == "paused" {
+			style = ", style=dashed"
+		}
+		fmt.Fprintf(w, "  %s [label=%s%s];\n", dotQuote(e.Name), dotQuote(label), style)
+	}
+	for _, edge := range chainEdges(entries) {
+		attrs := "label=" + dotQuote(edge.Condition)
+		if edge.Condition == chainFailure {
+			attrs += ", color=red"
+		}
+		fmt.Fprintf(w, "  %s -> %s [%s];\n", dotQuote(edge.From), dotQuote(edge.To), attrs)
+	}
+	fmt.Fprintln(w, "}")
+}
+
+func graphDetails(e CronEntry, withSchedule bool) string {
+	var details []string
+	if s := describeSchedule(e); withSchedule && s != "" {
+		details = append(details, s)
+	}
+	if e.Hook != nil {
+		details = append(details, "hook")
+	}
+	if e.Delay != "" {
+		details = append(details, "delay "+e.Delay)
+	}
+	if e.State == "paused" {
+		details = append(details, "paused")
+	}
+	if len(details) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(details, ", ") + ")"
+}
+
+func describeSchedule(e CronEntry) string {
+	switch {
+	case e.Watch != "":
+		return "watch " + e.Watch
+	case e.In != "":
+		return "in " + e.In
+	case e.Every != "" && e.At != "":
+		return "every " + e.Every + " at " + e.At
+	case e.Every != "":
+		return "every " + e.Every
+	case e.At != "":
+		return "at " + e.At
+	}
+	return ""
+}
+
+func dotQuote(value string) string {
+	return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+}
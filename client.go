@@ -1,6 +1,9 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -9,10 +12,16 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
+// buildURL returns the URL of an API call: on localhost, or on the
+// scheduler of $AUX4_CRON_URL.
 func buildURL(port, path string, params map[string]string) string {
 	u := fmt.Sprintf("http://localhost:%s%s", port, path)
+	if base := os.Getenv(urlEnv); base != "" {
+		u = strings.TrimSuffix(base, "/") + path
+	}
 	v := url.Values{}
 	for key, val := range params {
 		if val != "" {
@@ -25,8 +34,52 @@ func buildURL(port, path string, params map[string]string) string {
 	return u
 }
 
+// apiGet and apiPost call the scheduler API with the client token, if any,
+// through the scheduler's Unix socket when there is one and no
+// $AUX4_CRON_URL is set.
+func apiGet(rawURL string) (*http.Response, error) {
+	return apiDo(http.MethodGet, rawURL, "", nil)
+}
+
+func apiPost(rawURL, contentType string, body io.Reader) (*http.Response, error) {
+	return apiDo(http.MethodPost, rawURL, contentType, body)
+}
+
+func apiDo(method, rawURL, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+	client := http.DefaultClient
+	if os.Getenv(urlEnv) != "" {
+		if req.URL.Scheme == "https" {
+			config, err := clientTLSConfig()
+			if err != nil {
+				return nil, err
+			}
+			client = &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		}
+	} else if path := clientSocket(req.URL.Port()); path != "" {
+		client = socketClient(path)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if token := clientToken(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return client.Do(req)
+}
+
 func stopServer(args []string) {
 	port := getArg(args, 0, "8421")
+	wait := getArg(args, 1, "2 min")
+
+	waitFor, err := parseInterval(wait)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid wait: %v\n", err)
+		os.Exit(1)
+	}
 
 	pidFile := pidFilePath(port)
 	data, err := os.ReadFile(pidFile)
@@ -49,13 +102,35 @@ func stopServer(args []string) {
 		os.Exit(1)
 	}
 
-	if err := process.Signal(syscall.SIGTERM); err != nil {
-		fmt.Fprintf(os.Stderr, "failed to stop scheduler: %v\n", err)
-		os.Remove(pidFile)
-		os.Exit(1)
+	// Ask the server to drain and report the outcome; fall back to a signal
+	// when the API is unreachable
+	drain := "null"
+	resp, err := apiPost(buildURL(port, "/shutdown", nil), "application/json", nil)
+	if err == nil {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode < 400 {
+			drain = strings.TrimSpace(string(body))
+		}
+	}
+	if drain == "null" {
+		if err := process.Signal(syscall.SIGTERM); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to stop scheduler: %v\n", err)
+			os.Remove(pidFile)
+			os.Exit(1)
+		}
 	}
 
-	fmt.Fprintf(os.Stdout, "{\"status\":\"STOPPED\",\"port\":\"%s\",\"pid\":%d}\n", port, pid)
+	deadline := time.Now().Add(waitFor)
+	for processAlive(process) {
+		if time.Now().After(deadline) {
+			fmt.Fprintf(os.Stderr, "scheduler (pid %d) did not exit within %s\n", pid, waitFor)
+			os.Exit(1)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	fmt.Fprintf(os.Stdout, "{\"status\":\"STOPPED\",\"port\":\"%s\",\"pid\":%d,\"drain\":%s}\n", port, pid, drain)
 }
 
 func addEntry(args []string) {
@@ -66,30 +141,68 @@ func addEntry(args []string) {
 	in := getArg(args, 4, "")
 	max := getArg(args, 5, "")
 	run := getArg(args, 6, "")
+	retries := getArg(args, 7, "")
+	notify := getArg(args, 8, "")
+	notifyOn := getArg(args, 9, "")
+	timeout := getArg(args, 10, "")
+	env := getArg(args, 11, "")
+	envFile := getArg(args, 12, "")
+	workdir := getArg(args, 13, "")
+	user := getArg(args, 14, "")
+	group := getArg(args, 15, "")
+	argv := getArg(args, 16, "")
+	onSuccess := getArg(args, 17, "")
+	onFailure := getArg(args, 18, "")
+	after := getArg(args, 19, "")
+	delay := getArg(args, 20, "")
+	watch := getArg(args, 21, "")
+	debounce := getArg(args, 22, "")
+	minInterval := getArg(args, 23, "")
+	hookSecret := getArg(args, 24, "")
+	hookRate := getArg(args, 25, "")
 
 	if name == "" {
 		fmt.Fprintln(os.Stderr, "task name is required")
 		os.Exit(1)
 	}
-	if every == "" && in == "" && at == "" {
-		fmt.Fprintln(os.Stderr, "schedule expression is required (--every, --in, or --at)")
+	if every == "" && in == "" && at == "" && watch == "" && after == "" && hookSecret == "" {
+		fmt.Fprintln(os.Stderr, "schedule expression is required (--every, --in, --at, --watch, --after, or --hookSecret)")
 		os.Exit(1)
 	}
-	if run == "" {
-		fmt.Fprintln(os.Stderr, "run command is required")
+	if run == "" && argv == "" {
+		fmt.Fprintln(os.Stderr, "run command is required (--run or --args)")
 		os.Exit(1)
 	}
 
 	params := map[string]string{
-		"name":  name,
-		"every": every,
-		"at":    at,
-		"in":    in,
-		"max":   max,
-		"run":   run,
+		"name":        name,
+		"every":       every,
+		"at":          at,
+		"in":          in,
+		"max":         max,
+		"run":         run,
+		"retries":     retries,
+		"notify":      notify,
+		"notifyOn":    notifyOn,
+		"timeout":     timeout,
+		"env":         env,
+		"envFile":     envFile,
+		"workdir":     workdir,
+		"user":        user,
+		"group":       group,
+		"args":        argv,
+		"onSuccess":   onSuccess,
+		"onFailure":   onFailure,
+		"after":       after,
+		"delay":       delay,
+		"watch":       watch,
+		"debounce":    debounce,
+		"minInterval": minInterval,
+		"hookSecret":  hookSecret,
+		"hookRate":    hookRate,
 	}
 
-	resp, err := http.Post(buildURL(port, "/add", params), "application/json", nil)
+	resp, err := apiPost(buildURL(port, "/add", params), "application/json", nil)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
@@ -115,7 +228,7 @@ func removeEntry(args []string) {
 
 	params := map[string]string{"name": name}
 
-	resp, err := http.Post(buildURL(port, "/remove", params), "application/json", nil)
+	resp, err := apiPost(buildURL(port, "/remove", params), "application/json", nil)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
@@ -141,7 +254,7 @@ func pauseEntry(args []string) {
 
 	params := map[string]string{"name": name}
 
-	resp, err := http.Post(buildURL(port, "/pause", params), "application/json", nil)
+	resp, err := apiPost(buildURL(port, "/pause", params), "application/json", nil)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
@@ -167,7 +280,7 @@ func resumeEntry(args []string) {
 
 	params := map[string]string{"name": name}
 
-	resp, err := http.Post(buildURL(port, "/resume", params), "application/json", nil)
+	resp, err := apiPost(buildURL(port, "/resume", params), "application/json", nil)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
@@ -185,7 +298,7 @@ func resumeEntry(args []string) {
 func listEntries(args []string) {
 	port := getArg(args, 0, "8421")
 
-	resp, err := http.Get(buildURL(port, "/list", nil))
+	resp, err := apiGet(buildURL(port, "/list", nil))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
@@ -204,18 +317,414 @@ func showHistory(args []string) {
 	port := getArg(args, 0, "8421")
 	name := getArg(args, 1, "")
 	limit := getArg(args, 2, "10")
+	status := getArg(args, 3, "")
+	since := getArg(args, 4, "")
+	until := getArg(args, 5, "")
+	cursor := getArg(args, 6, "")
+	order := getArg(args, 7, "")
+
+	params := map[string]string{
+		"name":   name,
+		"limit":  limit,
+		"status": status,
+		"since":  since,
+		"until":  until,
+		"cursor": cursor,
+		"order":  order,
+	}
+
+	resp, err := apiGet(buildURL(port, "/history", params))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 400 {
+		fmt.Fprintf(os.Stderr, "%s\n", body)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stdout, "%s", body)
+	// The cursor goes to stderr so the entries stay valid JSON
+	if next := resp.Header.Get("X-Next-Cursor"); next != "" {
+		fmt.Fprintf(os.Stderr, "next page: --cursor %s\n", next)
+	}
+}
+
+func showAudit(args []string) {
+	port := getArg(args, 0, "8421")
+	name := getArg(args, 1, "")
+	action := getArg(args, 2, "")
+	caller := getArg(args, 3, "")
+	since := getArg(args, 4, "")
+	until := getArg(args, 5, "")
+	limit := getArg(args, 6, "50")
+	order := getArg(args, 7, "")
+
+	params := map[string]string{
+		"name":   name,
+		"action": action,
+		"caller": caller,
+		"since":  since,
+		"until":  until,
+		"limit":  limit,
+		"order":  order,
+	}
+
+	resp, err := apiGet(buildURL(port, "/audit", params))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 400 {
+		fmt.Fprintf(os.Stderr, "%s\n", body)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stdout, "%s", body)
+}
+
+// watchReconnect is how long watch keeps trying to reach a scheduler whose
+// stream ended, e.g. while it restarts.
+const watchReconnect = 30 * time.Second
+
+// watchEvents prints the events of the scheduler, one JSON object per line,
+// until count events were printed or the scheduler cannot be reached. A
+// dropped stream is resumed after the last event seen.
+func watchEvents(args []string) {
+	port := getArg(args, 0, "8421")
+	name := getArg(args, 1, "")
+	eventType := getArg(args, 2, "")
+	lastID := getArg(args, 3, "")
+	count, err := strconv.Atoi(getArg(args, 4, "0"))
+	if err != nil || count < 0 {
+		fmt.Fprintln(os.Stderr, "count must be a non-negative integer")
+		os.Exit(1)
+	}
+
+	params := map[string]string{"name": name, "type": eventType}
+	printed := 0
+	var lost time.Time
+	for {
+		params["lastEventId"] = lastID
+		resp, err := apiGet(buildURL(port, "/events", params))
+		if err != nil {
+			if lost.IsZero() || time.Since(lost) > watchReconnect {
+				fmt.Fprintf(os.Stderr, "error: %v\n", err)
+				os.Exit(1)
+			}
+			time.Sleep(time.Second)
+			continue
+		}
+		if resp.StatusCode >= 400 {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			fmt.Fprintf(os.Stderr, "%s\n", body)
+			os.Exit(1)
+		}
+
+		reader := bufio.NewReader(resp.Body)
+		var id, data string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				break
+			}
+			line = strings.TrimRight(line, "\r\n")
+			switch {
+			case line == "":
+				if data == "" {
+					continue
+				}
+				fmt.Fprintln(os.Stdout, data)
+				lastID, data = id, ""
+				printed++
+				if count > 0 && printed >= count {
+					resp.Body.Close()
+					return
+				}
+			case strings.HasPrefix(line, "id:"):
+				id = strings.TrimSpace(strings.TrimPrefix(line, "id:"))
+			case strings.HasPrefix(line, "data:"):
+				data = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+			}
+		}
+		resp.Body.Close()
+		lost = time.Now()
+	}
+}
+
+func showStats(args []string) {
+	port := getArg(args, 0, "8421")
+	name := getArg(args, 1, "")
+	window := getArg(args, 2, "")
+
+	params := map[string]string{
+		"name":   name,
+		"window": window,
+	}
+
+	resp, err := apiGet(buildURL(port, "/stats", params))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 400 {
+		fmt.Fprintf(os.Stderr, "%s\n", body)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stdout, "%s", body)
+}
+
+func showStatus(args []string) {
+	port := getArg(args, 0, "8421")
+
+	resp, err := apiGet(buildURL(port, "/readyz", nil))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "scheduler not running on port %s\n", port)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	fmt.Fprintf(os.Stdout, "%s", body)
+	if resp.StatusCode >= 400 {
+		os.Exit(1)
+	}
+}
+
+func testNotify(args []string) {
+	port := getArg(args, 0, "8421")
+	name := getArg(args, 1, "")
+
+	params := map[string]string{"name": name}
+
+	resp, err := apiPost(buildURL(port, "/notify/test", params), "application/json", nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 400 {
+		fmt.Fprintf(os.Stderr, "%s\n", body)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stdout, "%s", body)
+}
+
+func listRunning(args []string) {
+	port := getArg(args, 0, "8421")
+
+	resp, err := apiGet(buildURL(port, "/running", nil))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 400 {
+		fmt.Fprintf(os.Stderr, "%s\n", body)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stdout, "%s", body)
+}
+
+func killRun(args []string) {
+	port := getArg(args, 0, "8421")
+	run := getArg(args, 1, "")
+
+	if run == "" {
+		fmt.Fprintln(os.Stderr, "run id is required")
+		os.Exit(1)
+	}
+
+	params := map[string]string{"run": run}
+
+	resp, err := apiPost(buildURL(port, "/kill", params), "application/json", nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 400 {
+		fmt.Fprintf(os.Stderr, "%s\n", body)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stdout, "%s", body)
+}
+
+func runEntry(args []string) {
+	port := getArg(args, 0, "8421")
+	name := getArg(args, 1, "")
 
 	if name == "" {
-		fmt.Fprintln(os.Stderr, "task name is required")
+		fmt.Fprintln(os.Stderr, "name is required")
+		os.Exit(1)
+	}
+
+	params := map[string]string{"name": name}
+
+	resp, err := apiPost(buildURL(port, "/run", params), "application/json", nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 400 {
+		fmt.Fprintf(os.Stderr, "%s\n", body)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stdout, "%s", body)
+}
+
+func applyManifest(args []string) {
+	port := getArg(args, 0, "8421")
+	file := getArg(args, 1, "")
+	prune := getArg(args, 2, "false")
+	dryRun := getArg(args, 3, "false")
+
+	if file == "" {
+		fmt.Fprintln(os.Stderr, "manifest file is required")
+		os.Exit(1)
+	}
+
+	entries, err := loadManifest(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	for _, entry := range entries {
+		if entry.State == "" {
+			entry.State = "active"
+		}
+		if err := validateEntry(entry); err != nil {
+			fmt.Fprintf(os.Stderr, "entry %q: %v\n", entry.Name, err)
+			os.Exit(1)
+		}
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
 
 	params := map[string]string{
-		"name":  name,
-		"limit": limit,
+		"prune":  prune,
+		"dryRun": dryRun,
+	}
+
+	resp, err := apiPost(buildURL(port, "/apply", params), "application/json", bytes.NewReader(data))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 400 {
+		fmt.Fprintf(os.Stderr, "%s\n", body)
+		os.Exit(1)
+	}
+
+	var result ApplyResult
+	if err := json.Unmarshal(body, &result); err == nil {
+		printPlan(os.Stderr, result.Plan)
+	}
+	fmt.Fprintf(os.Stdout, "%s", body)
+}
+
+func importCrontab(args []string) {
+	port := getArg(args, 0, "8421")
+	file := getArg(args, 1, "")
+	dryRun := getArg(args, 2, "false")
+
+	if file == "" {
+		fmt.Fprintln(os.Stderr, "crontab file is required")
+		os.Exit(1)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	entries, warnings := parseCrontab(data)
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", warning)
+	}
+	if entries == nil {
+		entries = []CronEntry{}
+	}
+
+	payload, err := json.Marshal(entries)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	resp, err := apiPost(buildURL(port, "/apply", map[string]string{"dryRun": dryRun}), "application/json", bytes.NewReader(payload))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 400 {
+		fmt.Fprintf(os.Stderr, "%s\n", body)
+		os.Exit(1)
+	}
+
+	var result ApplyResult
+	if err := json.Unmarshal(body, &result); err == nil {
+		printPlan(os.Stderr, result.Plan)
+	}
+	fmt.Fprintf(os.Stdout, "%s", body)
+}
+
+func exportEntries(args []string) {
+	port := getArg(args, 0, "8421")
+	format := getArg(args, 1, "json")
+	reveal := getArg(args, 2, "false")
+
+	resp, err := apiGet(buildURL(port, "/export", map[string]string{"format": format, "reveal": reveal}))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
 	}
+	defer resp.Body.Close()
 
-	resp, err := http.Get(buildURL(port, "/history", params))
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 400 {
+		fmt.Fprintf(os.Stderr, "%s\n", body)
+		os.Exit(1)
+	}
+	for _, warning := range resp.Header.Values("X-Export-Warning") {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", warning)
+	}
+	fmt.Fprintf(os.Stdout, "%s", body)
+}
+
+func showGraph(args []string) {
+	port := getArg(args, 0, "8421")
+	format := getArg(args, 1, "text")
+
+	resp, err := apiGet(buildURL(port, "/graph", map[string]string{"format": format}))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
@@ -229,3 +738,49 @@ func showHistory(args []string) {
 	}
 	fmt.Fprintf(os.Stdout, "%s", body)
 }
+
+func createToken(args []string) {
+	dir := getArg(args, 0, ".")
+	name := getArg(args, 1, "")
+	role := getArg(args, 2, roleRead)
+
+	secret, err := NewTokenStore(dir).Create(name, role)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	NewAuditLog(dir).Record(AuditEntry{Action: auditTokenAdd, Name: name, Caller: localCaller(), Source: "token create"})
+	data, _ := json.Marshal(map[string]string{"name": name, "role": role, "token": secret})
+	fmt.Fprintf(os.Stdout, "%s\n", data)
+}
+
+func listTokens(args []string) {
+	dir := getArg(args, 0, ".")
+
+	tokens, err := NewTokenStore(dir).List()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	if tokens == nil {
+		tokens = []APIToken{}
+	}
+	data, _ := json.Marshal(tokens)
+	fmt.Fprintf(os.Stdout, "%s\n", data)
+}
+
+func revokeToken(args []string) {
+	dir := getArg(args, 0, ".")
+	name := getArg(args, 1, "")
+
+	if name == "" {
+		fmt.Fprintln(os.Stderr, "token name is required")
+		os.Exit(1)
+	}
+	if err := NewTokenStore(dir).Revoke(name); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	NewAuditLog(dir).Record(AuditEntry{Action: auditTokenDel, Name: name, Caller: localCaller(), Source: "token revoke"})
+	fmt.Fprintf(os.Stdout, "{\"name\":%q,\"status\":\"REVOKED\"}\n", name)
+}
@@ -2,26 +2,95 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"net/http"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 type CronEntry struct {
-	Name  string `json:"name"`
-	Every string `json:"every,omitempty"`
-	At    string `json:"at,omitempty"`
-	In    string `json:"in,omitempty"`
-	Max   int    `json:"max,omitempty"`
-	Run   string `json:"run"`
-	State string `json:"state"`
+	Name    string            `json:"name"`
+	Every   string            `json:"every,omitempty"`
+	At      string            `json:"at,omitempty"`
+	In      string            `json:"in,omitempty"`
+	Max     int               `json:"max,omitempty"`
+	Retries int               `json:"retries,omitempty"`
+	Timeout string            `json:"timeout,omitempty"`
+	Run     string            `json:"run,omitempty"`
+	Args    []string          `json:"args,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	EnvFile string            `json:"envFile,omitempty"`
+	Workdir string            `json:"workdir,omitempty"`
+	User    string            `json:"user,omitempty"`
+	Group   string            `json:"group,omitempty"`
+	// Watch is a glob of files whose changes trigger the entry, waiting
+	// for Debounce of quiet and at least MinInterval between runs
+	Watch       string `json:"watch,omitempty"`
+	Debounce    string `json:"debounce,omitempty"`
+	MinInterval string `json:"minInterval,omitempty"`
+	// OnSuccess and OnFailure name the entries run when this one
+	// finishes; After names the entries this one runs after
+	OnSuccess []string `json:"onSuccess,omitempty"`
+	OnFailure []string `json:"onFailure,omitempty"`
+	After     []string `json:"after,omitempty"`
+	// Delay postpones runs triggered by another entry
+	Delay  string       `json:"delay,omitempty"`
+	Hook   *EntryHook   `json:"hook,omitempty"`
+	Notify []NotifyHook `json:"notify,omitempty"`
+	State  string       `json:"state"`
 }
 
 type HistoryEntry struct {
-	Name      string `json:"name"`
-	JobID     string `json:"jobId"`
-	Timestamp string `json:"timestamp"`
-	Status    string `json:"status"`
+	ID    int64  `json:"id"`
+	Name  string `json:"name"`
+	RunID string `json:"runId,omitempty"`
+	// UpstreamRunID is the run that triggered this one through a dependency
+	UpstreamRunID string `json:"upstreamRunId,omitempty"`
+	JobID         string `json:"jobId"`
+	Timestamp     string `json:"timestamp"`
+	Status        string `json:"status"`
+	Attempt       int    `json:"attempt,omitempty"`
+	DurationMs    int64  `json:"durationMs,omitempty"`
+	// ExitCode is the exit code of the job, once it finished
+	ExitCode *int `json:"exitCode,omitempty"`
+	// Files are the paths that triggered a watch entry
+	Files []string `json:"files,omitempty"`
+	// Caller and SourceIP identify the webhook call that triggered the run
+	Caller   string `json:"caller,omitempty"`
+	SourceIP string `json:"sourceIp,omitempty"`
+}
+
+type HistoryQuery struct {
+	Name   string
+	Status string
+	Since  time.Time
+	Until  time.Time
+	Cursor int64
+	Limit  int
+	Order  string
+}
+
+// ReloadDiff summarizes how a reloaded .cron.json differs from the entries
+// that were loaded.
+type ReloadDiff struct {
+	Added     []string `json:"added"`
+	Updated   []string `json:"updated"`
+	Removed   []string `json:"removed"`
+	Unchanged int      `json:"unchanged"`
+}
+
+func (d *ReloadDiff) Changed() bool {
+	return len(d.Added) > 0 || len(d.Updated) > 0 || len(d.Removed) > 0
+}
+
+func (d *ReloadDiff) String() string {
+	return fmt.Sprintf("%d added %v, %d updated %v, %d removed %v, %d unchanged",
+		len(d.Added), d.Added, len(d.Updated), d.Updated, len(d.Removed), d.Removed, d.Unchanged)
 }
 
 type CronStore struct {
@@ -29,6 +98,8 @@ type CronStore struct {
 	dir     string
 	entries []CronEntry
 	history []HistoryEntry
+	lastID  int64
+	loaded  bool
 }
 
 func NewCronStore(dir string) *CronStore {
@@ -39,6 +110,109 @@ func NewCronStore(dir string) *CronStore {
 	}
 }
 
+// validateEntry checks an entry before it is stored, whether it comes from
+// the API or from a .cron.json edited by hand.
+func validateEntry(entry CronEntry) error {
+	if entry.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if !hasSchedule(entry) && len(entry.After) == 0 && entry.Hook == nil {
+		return fmt.Errorf("every, in, at, watch, hook, or after is required")
+	}
+	if entry.Watch != "" && (entry.Every != "" || entry.In != "" || entry.At != "") {
+		return fmt.Errorf("watch cannot be used with every, in, or at")
+	}
+	if entry.Watch == "" && (entry.Debounce != "" || entry.MinInterval != "") {
+		return fmt.Errorf("debounce and minInterval require watch")
+	}
+	if entry.Debounce != "" {
+		if _, err := parseInterval(entry.Debounce); err != nil {
+			return fmt.Errorf("debounce must be an interval (e.g. 2s, 1 min)")
+		}
+	}
+	if entry.MinInterval != "" {
+		if _, err := parseInterval(entry.MinInterval); err != nil {
+			return fmt.Errorf("minInterval must be an interval (e.g. 30s, 5 min)")
+		}
+	}
+	if entry.Watch != "" {
+		if _, err := filepath.Match(entry.Watch, ""); err != nil {
+			return fmt.Errorf("invalid watch pattern: %s", entry.Watch)
+		}
+	}
+	if entry.Run == "" && len(entry.Args) == 0 {
+		return fmt.Errorf("run or args is required")
+	}
+	if entry.Run != "" && len(entry.Args) > 0 {
+		return fmt.Errorf("run and args cannot be used together")
+	}
+	if err := validateArgs(entry.Args); err != nil {
+		return err
+	}
+	if hasSchedule(entry) {
+		if _, err := entrySchedule(entry); err != nil {
+			return err
+		}
+	}
+	for _, item := range entry.After {
+		name, _, err := parseAfter(item)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			return fmt.Errorf("after requires entry names")
+		}
+	}
+	for _, name := range append(append([]string{}, entry.OnSuccess...), entry.OnFailure...) {
+		if name == "" {
+			return fmt.Errorf("onSuccess and onFailure require entry names")
+		}
+	}
+	if entry.Hook != nil {
+		if entry.Hook.Secret == "" {
+			return fmt.Errorf("hook requires a secret")
+		}
+		if entry.Hook.Rate < 0 {
+			return fmt.Errorf("hook rate must be a non-negative integer")
+		}
+	}
+	if entry.Delay != "" {
+		if _, err := parseInterval(entry.Delay); err != nil {
+			return fmt.Errorf("delay must be an interval (e.g. 30s, 5 min)")
+		}
+	}
+	if entry.Max < 0 {
+		return fmt.Errorf("max must be a positive integer")
+	}
+	if entry.Retries < 0 {
+		return fmt.Errorf("retries must be a non-negative integer")
+	}
+	if entry.Timeout != "" {
+		if d, err := parseInterval(entry.Timeout); err != nil || d <= 0 {
+			return fmt.Errorf("timeout must be a positive interval (e.g. 30s, 5 min)")
+		}
+	}
+	for key := range entry.Env {
+		if !envNameRegex.MatchString(key) {
+			return fmt.Errorf("invalid env variable name: %s", key)
+		}
+	}
+	for _, hook := range entry.Notify {
+		if hook.URL == "" && hook.Command == "" {
+			return fmt.Errorf("notify hook requires a url or command")
+		}
+		for _, event := range hook.Events {
+			if err := validateNotifyEvent(event); err != nil {
+				return err
+			}
+		}
+	}
+	if entry.State != "active" && entry.State != "paused" {
+		return fmt.Errorf("invalid state: %s (expected active or paused)", entry.State)
+	}
+	return nil
+}
+
 func (s *CronStore) cronFilePath() string {
 	return filepath.Join(s.dir, ".cron.json")
 }
@@ -47,6 +221,10 @@ func (s *CronStore) historyFilePath() string {
 	return filepath.Join(s.dir, ".cron-history.json")
 }
 
+func (s *CronStore) notifyFilePath() string {
+	return filepath.Join(s.dir, ".cron-notify.json")
+}
+
 func (s *CronStore) Load() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -55,11 +233,42 @@ func (s *CronStore) Load() error {
 	if err != nil {
 		if os.IsNotExist(err) {
 			s.entries = []CronEntry{}
+			s.loaded = true
 			return nil
 		}
 		return err
 	}
-	return json.Unmarshal(data, &s.entries)
+	if err := json.Unmarshal(data, &s.entries); err != nil {
+		return err
+	}
+	s.loaded = true
+	return nil
+}
+
+func (s *CronStore) Loaded() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.loaded
+}
+
+// HistoryWritable reports whether history can be saved, without touching
+// the history file contents.
+func (s *CronStore) HistoryWritable() bool {
+	f, err := os.OpenFile(s.historyFilePath(), os.O_WRONLY, 0)
+	if err == nil {
+		f.Close()
+		return true
+	}
+	if !os.IsNotExist(err) {
+		return false
+	}
+	tmp, err := os.CreateTemp(s.dir, ".cron-history-*.tmp")
+	if err != nil {
+		return false
+	}
+	tmp.Close()
+	os.Remove(tmp.Name())
+	return true
 }
 
 func (s *CronStore) LoadHistory() error {
@@ -74,7 +283,40 @@ func (s *CronStore) LoadHistory() error {
 		}
 		return err
 	}
-	return json.Unmarshal(data, &s.history)
+	if err := json.Unmarshal(data, &s.history); err != nil {
+		return err
+	}
+
+	// Records written before ids existed get one assigned in file order
+	for _, h := range s.history {
+		if h.ID > s.lastID {
+			s.lastID = h.ID
+		}
+	}
+	for i := range s.history {
+		if s.history[i].ID == 0 {
+			s.lastID++
+			s.history[i].ID = s.lastID
+		}
+	}
+	return nil
+}
+
+// LoadNotifyHooks reads the global notification hooks, which apply to every
+// entry in addition to its own.
+func (s *CronStore) LoadNotifyHooks() ([]NotifyHook, error) {
+	data, err := os.ReadFile(s.notifyFilePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var hooks []NotifyHook
+	if err := json.Unmarshal(data, &hooks); err != nil {
+		return nil, err
+	}
+	return hooks, nil
 }
 
 func (s *CronStore) save() error {
@@ -93,6 +335,74 @@ func (s *CronStore) saveHistory() error {
 	return os.WriteFile(s.historyFilePath(), data, 0644)
 }
 
+// Reload re-reads .cron.json and replaces the entries with its contents. A
+// missing or invalid file is rejected and leaves the entries untouched.
+func (s *CronStore) Reload() (*ReloadDiff, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.cronFilePath())
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []CronEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for i := range entries {
+		if entries[i].State == "" {
+			entries[i].State = "active"
+		}
+		if err := validateEntry(entries[i]); err != nil {
+			return nil, fmt.Errorf("entry %q: %v", entries[i].Name, err)
+		}
+		if seen[entries[i].Name] {
+			return nil, errEntryExists(entries[i].Name)
+		}
+		seen[entries[i].Name] = true
+	}
+	if err := validateGraph(entries); err != nil {
+		return nil, err
+	}
+
+	current := make(map[string]CronEntry, len(s.entries))
+	for _, e := range s.entries {
+		current[e.Name] = e
+	}
+
+	diff := &ReloadDiff{Added: []string{}, Updated: []string{}, Removed: []string{}}
+	for _, e := range entries {
+		old, ok := current[e.Name]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, e.Name)
+		case !reflect.DeepEqual(old, e):
+			diff.Updated = append(diff.Updated, e.Name)
+		default:
+			diff.Unchanged++
+		}
+		delete(current, e.Name)
+	}
+	for _, e := range s.entries {
+		if _, ok := current[e.Name]; ok {
+			diff.Removed = append(diff.Removed, e.Name)
+		}
+	}
+
+	s.entries = entries
+	return diff, nil
+}
+
+// FlushHistory writes the history to disk. Entries are not rewritten, so a
+// .cron.json edited on disk but not reloaded is left as is.
+func (s *CronStore) FlushHistory() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.saveHistory()
+}
+
 func (s *CronStore) Add(entry CronEntry) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -102,7 +412,11 @@ func (s *CronStore) Add(entry CronEntry) error {
 			return errEntryExists(entry.Name)
 		}
 	}
-	s.entries = append(s.entries, entry)
+	entries := append(append([]CronEntry{}, s.entries...), entry)
+	if err := validateGraph(entries); err != nil {
+		return err
+	}
+	s.entries = entries
 	return s.save()
 }
 
@@ -120,10 +434,60 @@ func (s *CronStore) Remove(name string) error {
 	if idx == -1 {
 		return errEntryNotFound(name)
 	}
+	if names := dependents(s.entries, name); len(names) > 0 {
+		return errEntryInUse(name, names)
+	}
 	s.entries = append(s.entries[:idx], s.entries[idx+1:]...)
 	return s.save()
 }
 
+// Retire removes an entry that finished its runs. Instead of refusing when
+// other entries refer to it, it drops those references and returns the
+// entries it changed as they were before.
+func (s *CronStore) Retire(name string) ([]CronEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	found := false
+	var entries, detached []CronEntry
+	for _, e := range s.entries {
+		if e.Name == name {
+			found = true
+			continue
+		}
+		if next, changed := detach(e, name); changed {
+			detached = append(detached, e)
+			e = next
+		}
+		entries = append(entries, e)
+	}
+	if !found {
+		return nil, errEntryNotFound(name)
+	}
+	s.entries = entries
+	return detached, s.save()
+}
+
+// Update replaces the entry of the same name and returns the one it
+// replaced.
+func (s *CronStore) Update(entry CronEntry) (*CronEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, e := range s.entries {
+		if e.Name == entry.Name {
+			entries := append([]CronEntry{}, s.entries...)
+			entries[i] = entry
+			if err := validateGraph(entries); err != nil {
+				return nil, err
+			}
+			s.entries = entries
+			return &e, s.save()
+		}
+	}
+	return nil, errEntryNotFound(entry.Name)
+}
+
 func (s *CronStore) SetState(name, state string) (*CronEntry, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -161,10 +525,13 @@ func (s *CronStore) List() []CronEntry {
 	return result
 }
 
-func (s *CronStore) AddHistory(entry HistoryEntry) error {
+// AddHistory records the entry and returns the id it was given.
+func (s *CronStore) AddHistory(entry HistoryEntry) (int64, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	s.lastID++
+	entry.ID = s.lastID
 	s.history = append(s.history, entry)
 
 	// Keep last 1000 entries
@@ -172,33 +539,131 @@ func (s *CronStore) AddHistory(entry HistoryEntry) error {
 		s.history = s.history[len(s.history)-1000:]
 	}
 
-	return s.saveHistory()
+	return entry.ID, s.saveHistory()
+}
+
+// UpdateHistory replaces the history entry with the same id. Entries no
+// longer retained are ignored.
+func (s *CronStore) UpdateHistory(entry HistoryEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Ids are not in file order once old records got theirs on load, and
+	// the records updated are recent, so look from the end
+	for i := len(s.history) - 1; i >= 0; i-- {
+		if s.history[i].ID == entry.ID {
+			s.history[i] = entry
+			return s.saveHistory()
+		}
+	}
+	return nil
 }
 
-func (s *CronStore) GetHistory(name string, limit int) []HistoryEntry {
+// PendingJobs returns the runs recorded at or after since whose job was
+// started but not seen finishing.
+func (s *CronStore) PendingJobs(since time.Time) []HistoryEntry {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	var result []HistoryEntry
+	var pending []HistoryEntry
 	for _, h := range s.history {
-		if h.Name == name {
-			result = append(result, h)
+		if h.Status != "TRIGGERED" || h.JobID == "" {
+			continue
+		}
+		if ts, err := time.Parse(time.RFC3339, h.Timestamp); err == nil && !ts.Before(since) {
+			pending = append(pending, h)
 		}
 	}
+	return pending
+}
+
+// LastStatus returns the status of the most recent history entry for name.
+func (s *CronStore) LastStatus(name string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	if result == nil {
-		result = []HistoryEntry{}
+	for i := len(s.history) - 1; i >= 0; i-- {
+		if s.history[i].Name == name {
+			return s.history[i].Status
+		}
 	}
+	return ""
+}
 
-	if limit > 0 && len(result) > limit {
-		result = result[len(result)-limit:]
+// QueryHistory returns the page of history matching q and whether more
+// entries exist beyond it. Pages are walked with the id of the last entry
+// returned as the next cursor. In ascending order without a cursor or since
+// the most recent entries are returned, oldest first.
+func (s *CronStore) QueryHistory(q HistoryQuery) ([]HistoryEntry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var matched []HistoryEntry
+	for _, h := range s.history {
+		if q.Name != "" && h.Name != q.Name {
+			continue
+		}
+		if q.Status != "" && h.Status != q.Status {
+			continue
+		}
+		if !q.Since.IsZero() || !q.Until.IsZero() {
+			ts, err := time.Parse(time.RFC3339, h.Timestamp)
+			if err != nil {
+				continue
+			}
+			if !q.Since.IsZero() && ts.Before(q.Since) {
+				continue
+			}
+			if !q.Until.IsZero() && ts.After(q.Until) {
+				continue
+			}
+		}
+		matched = append(matched, h)
 	}
 
-	return result
+	sort.SliceStable(matched, func(i, j int) bool {
+		return matched[i].ID < matched[j].ID
+	})
+
+	result := []HistoryEntry{}
+	more := false
+
+	if q.Order == "desc" {
+		end := len(matched)
+		if q.Cursor > 0 {
+			end = sort.Search(len(matched), func(i int) bool { return matched[i].ID >= q.Cursor })
+		}
+		start := 0
+		if q.Limit > 0 && end-q.Limit > 0 {
+			start = end - q.Limit
+			more = true
+		}
+		for i := end - 1; i >= start; i-- {
+			result = append(result, matched[i])
+		}
+		return result, more
+	}
+
+	start := 0
+	if q.Cursor > 0 {
+		start = sort.Search(len(matched), func(i int) bool { return matched[i].ID > q.Cursor })
+	} else if q.Since.IsZero() && q.Limit > 0 && len(matched) > q.Limit {
+		start = len(matched) - q.Limit
+	}
+	end := len(matched)
+	if q.Limit > 0 && start+q.Limit < end {
+		end = start + q.Limit
+		more = true
+	}
+	result = append(result, matched[start:end]...)
+	return result, more
 }
 
 type cronError struct {
 	message string
+	// status is the HTTP status to answer with, when not the handler's
+	// default
+	status int
 }
 
 func (e *cronError) Error() string {
@@ -212,3 +677,35 @@ func errEntryExists(name string) error {
 func errEntryNotFound(name string) error {
 	return &cronError{message: "entry " + name + " not found"}
 }
+
+func errEntryInUse(name string, by []string) error {
+	return &cronError{message: "entry " + name + " is used by " + strings.Join(by, ", "), status: http.StatusConflict}
+}
+
+func errInvalidEntry(err error) error {
+	return &cronError{message: err.Error(), status: http.StatusBadRequest}
+}
+
+func errInvalidGraph(message string) error {
+	return &cronError{message: message, status: http.StatusBadRequest}
+}
+
+func errInvalidQuery(message string) error {
+	return &cronError{message: message, status: http.StatusBadRequest}
+}
+
+func errForbidden(message string) error {
+	return &cronError{message: message, status: http.StatusForbidden}
+}
+
+func errRunNotFound(id string) error {
+	return &cronError{message: "run " + id + " not found"}
+}
+
+func errRunNotQueued(name string) error {
+	return &cronError{message: "run of " + name + " not queued: previous run still in progress or run queue is full", status: http.StatusConflict}
+}
+
+func errNotRunning() error {
+	return &cronError{message: "scheduler is shutting down", status: http.StatusServiceUnavailable}
+}
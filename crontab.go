@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	crontabEnvRegex = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)\s*=\s*(.*)$`)
+	slugRegex       = regexp.MustCompile(`[^a-z0-9]+`)
+	unitNameRegex   = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+)
+
+// crontabIgnoredEnv are crontab variables that configure cron itself rather
+// than the commands it runs.
+var crontabIgnoredEnv = map[string]bool{
+	"SHELL":        true,
+	"MAILTO":       true,
+	"MAILFROM":     true,
+	"CRON_TZ":      true,
+	"TZ":           true,
+	"RANDOM_DELAY": true,
+}
+
+var crontabMacros = map[string][]string{
+	"@hourly":   {"0", "*", "*", "*", "*"},
+	"@daily":    {"0", "0", "*", "*", "*"},
+	"@midnight": {"0", "0", "*", "*", "*"},
+	"@weekly":   {"0", "0", "*", "*", "0"},
+	"@monthly":  {"0", "0", "1", "*", "*"},
+}
+
+var crontabWeekdays = []string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+
+// parseCrontab converts the lines of a user crontab into entries. Variable
+// assignments go into the env of the entries that follow them. Lines whose
+// schedule cannot be expressed as an entry are skipped and reported as
+// warnings.
+func parseCrontab(data []byte) ([]CronEntry, []string) {
+	var entries []CronEntry
+	var warnings []string
+	env := make(map[string]string)
+	names := make(map[string]bool)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if matches := crontabEnvRegex.FindStringSubmatch(line); matches != nil {
+			name, value := matches[1], unquote(strings.TrimSpace(matches[2]))
+			if crontabIgnoredEnv[name] {
+				warnings = append(warnings, fmt.Sprintf("line %d: %s is not supported, ignored", lineNumber, name))
+				continue
+			}
+			env[name] = value
+			continue
+		}
+
+		var fields []string
+		var command string
+		if strings.HasPrefix(line, "@") {
+			parts := strings.Fields(line)
+			macro := strings.ToLower(parts[0])
+			if len(parts) < 2 {
+				warnings = append(warnings, fmt.Sprintf("line %d: missing command", lineNumber))
+				continue
+			}
+			if macro == "@reboot" || macro == "@yearly" || macro == "@annually" {
+				warnings = append(warnings, fmt.Sprintf("line %d: %s cannot be represented, skipped", lineNumber, macro))
+				continue
+			}
+			expanded, ok := crontabMacros[macro]
+			if !ok {
+				warnings = append(warnings, fmt.Sprintf("line %d: unknown macro %s, skipped", lineNumber, macro))
+				continue
+			}
+			fields = expanded
+			command = strings.TrimSpace(strings.TrimPrefix(line, parts[0]))
+		} else {
+			parts := strings.Fields(line)
+			if len(parts) < 6 {
+				warnings = append(warnings, fmt.Sprintf("line %d: expected 5 schedule fields and a command, skipped", lineNumber))
+				continue
+			}
+			fields = parts[:5]
+			command = line
+			for _, field := range fields {
+				command = strings.TrimSpace(strings.TrimPrefix(command, field))
+			}
+		}
+
+		if strings.Contains(strings.ReplaceAll(command, `\%`, ""), "%") {
+			warnings = append(warnings, fmt.Sprintf("line %d: %% in the command is kept literally, not converted to stdin", lineNumber))
+		}
+		command = strings.ReplaceAll(command, `\%`, "%")
+
+		every, at, err := crontabSchedule(fields)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("line %d: %v, skipped", lineNumber, err))
+			continue
+		}
+		if at == "" {
+			// Intervals count from when the task is scheduled, while crontab
+			// fires on the clock: */15 at :00, :15, :30 and :45
+			warnings = append(warnings, fmt.Sprintf("line %d: %q runs every %s from when the task is scheduled, not on the clock", lineNumber, strings.Join(fields, " "), every))
+		}
+
+		entry := CronEntry{Name: uniqueName(commandSlug(command, lineNumber), names), Every: every, At: at, Run: command, State: "active"}
+		if len(env) > 0 {
+			entry.Env = make(map[string]string, len(env))
+			for key, value := range env {
+				entry.Env[key] = value
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, warnings
+}
+
+// crontabSchedule maps the five crontab schedule fields onto every/at.
+func crontabSchedule(fields []string) (string, string, error) {
+	minute, hour, dom, month, dow := fields[0], fields[1], fields[2], fields[3], fields[4]
+	expr := strings.Join(fields, " ")
+	unsupported := fmt.Errorf("schedule %q cannot be represented", expr)
+
+	if month != "*" {
+		return "", "", unsupported
+	}
+
+	// Intervals: * * * * *, */N * * * * and 0 */N * * *
+	if dom == "*" && dow == "*" {
+		if hour == "*" {
+			if minute == "*" {
+				return "1 minute", "", nil
+			}
+			if n, ok := stepOf(minute); ok && 60%n == 0 {
+				return fmt.Sprintf("%d minutes", n), "", nil
+			}
+		}
+		if minute == "0" {
+			if hour == "*" {
+				return "1 hour", "", nil
+			}
+			if n, ok := stepOf(hour); ok && 24%n == 0 {
+				return fmt.Sprintf("%d hours", n), "", nil
+			}
+		}
+	}
+
+	m, errM := strconv.Atoi(minute)
+	h, errH := strconv.Atoi(hour)
+	if errM != nil || errH != nil || m < 0 || m > 59 || h < 0 || h > 23 {
+		return "", "", unsupported
+	}
+	at := fmt.Sprintf("%02d:%02d", h, m)
+
+	switch {
+	case dom == "*" && dow == "*":
+		return "1 day", at, nil
+	case dom == "1" && dow == "*":
+		return "1 month", at, nil
+	case dom == "*":
+		if every, ok := crontabDays(dow); ok {
+			return every, at, nil
+		}
+	}
+	return "", "", unsupported
+}
+
+// crontabDays maps a day-of-week field onto a weekday name, weekday or
+// weekend.
+func crontabDays(dow string) (string, bool) {
+	switch strings.ToLower(dow) {
+	case "1-5", "mon-fri":
+		return "weekday", true
+	case "0,6", "6,0", "6-7", "6,7", "sat,sun", "sun,sat":
+		return "weekend", true
+	}
+	if n, err := strconv.Atoi(dow); err == nil && n >= 0 && n <= 7 {
+		return crontabWeekdays[n%7], true
+	}
+	for _, day := range crontabWeekdays {
+		if strings.ToLower(dow) == day[:3] {
+			return day, true
+		}
+	}
+	return "", false
+}
+
+func stepOf(field string) (int, bool) {
+	if !strings.HasPrefix(field, "*/") {
+		return 0, false
+	}
+	n, err := strconv.Atoi(field[2:])
+	return n, err == nil && n > 0
+}
+
+// commandSlug derives an entry name from the program and arguments of a
+// command.
+func commandSlug(command string, lineNumber int) string {
+	words := strings.Fields(command)
+	if len(words) > 0 {
+		program := words[0]
+		if i := strings.LastIndex(program, "/"); i >= 0 {
+			program = program[i+1:]
+		}
+		words[0] = program
+	}
+	slug := strings.Trim(slugRegex.ReplaceAllString(strings.ToLower(strings.Join(words, " ")), "-"), "-")
+	if len(slug) > 32 {
+		slug = strings.TrimRight(slug[:32], "-")
+	}
+	if slug == "" {
+		return fmt.Sprintf("crontab-%d", lineNumber)
+	}
+	return slug
+}
+
+func uniqueName(name string, used map[string]bool) string {
+	candidate := name
+	for i := 2; used[candidate]; i++ {
+		candidate = fmt.Sprintf("%s-%d", name, i)
+	}
+	used[candidate] = true
+	return candidate
+}
+
+func unquote(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// crontabValue quotes a variable value when crontab would not keep it as
+// it is.
+func crontabValue(value string) string {
+	if value == "" || strings.TrimSpace(value) != value || unquote(value) != value {
+		return `"` + value + `"`
+	}
+	return value
+}
+
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// renderEntries renders entries in the given format: json or yaml (both
+// accepted by apply), crontab or systemd. Entries the format cannot
+// represent are left out with a comment in their place; every entry or
+// setting that is lost is returned as a warning.
+func renderEntries(entries []CronEntry, format string) ([]byte, []string, error) {
+	switch format {
+	case "json":
+		data, err := json.MarshalIndent(map[string][]CronEntry{"entries": entries}, "", "  ")
+		return append(data, '\n'), nil, err
+	case "yaml":
+		return exportYAML(entries)
+	case "crontab":
+		return exportCrontab(entries)
+	case "systemd":
+		return exportSystemd(entries)
+	}
+	return nil, nil, fmt.Errorf("invalid format: %s (expected crontab, json, yaml or systemd)", format)
+}
+
+func exportYAML(entries []CronEntry) ([]byte, []string, error) {
+	// Round-trip through JSON so the YAML uses the JSON field names
+	data, err := json.Marshal(map[string][]CronEntry{"entries": entries})
+	if err != nil {
+		return nil, nil, err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, nil, err
+	}
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(doc); err != nil {
+		return nil, nil, err
+	}
+	return out.Bytes(), nil, nil
+}
+
+// exportCrontab writes the entries as crontab lines. Their env becomes
+// variable assignments, written when a value changes; crontab cannot unset
+// a variable, so one set for an earlier entry also applies to later ones.
+func exportCrontab(entries []CronEntry) ([]byte, []string, error) {
+	var out bytes.Buffer
+	var warnings []string
+	env := make(map[string]string)
+	for _, entry := range entries {
+		fields, err := entryCrontabFields(entry)
+		var command string
+		if err == nil {
+			command, err = exportCommand(entry)
+		}
+		if err != nil {
+			warning := fmt.Sprintf("%s: %v, skipped", entry.Name, err)
+			warnings = append(warnings, warning)
+			fmt.Fprintf(&out, "# %s\n\n", warning)
+			continue
+		}
+		for _, ignored := range unsupportedSettings(entry, false) {
+			warnings = append(warnings, fmt.Sprintf("%s: %s is not supported, ignored", entry.Name, ignored))
+		}
+
+		for _, key := range sortedKeys(env) {
+			if _, ok := entry.Env[key]; !ok {
+				warnings = append(warnings, fmt.Sprintf("%s: env %s of an earlier task also applies", entry.Name, key))
+			}
+		}
+		fmt.Fprintf(&out, "# %s\n", entry.Name)
+		for _, key := range sortedKeys(entry.Env) {
+			if value, ok := env[key]; ok && value == entry.Env[key] {
+				continue
+			}
+			env[key] = entry.Env[key]
+			fmt.Fprintf(&out, "%s=%s\n", key, crontabValue(entry.Env[key]))
+		}
+		line := fields + " " + strings.ReplaceAll(command, "%", `\%`)
+		if entry.State == "paused" {
+			line = "# " + line
+		}
+		fmt.Fprintln(&out, line)
+		fmt.Fprintln(&out)
+	}
+	return out.Bytes(), warnings, nil
+}
+
+// entryCrontabFields returns the crontab schedule fields for an entry.
+func entryCrontabFields(entry CronEntry) (string, error) {
+	if !hasSchedule(entry) {
+		return "", fmt.Errorf("tasks that only run when triggered cannot be represented")
+	}
+	sched, err := entrySchedule(entry)
+	if err != nil {
+		return "", err
+	}
+	switch sched.Type {
+	case scheduleInterval:
+		switch {
+		case sched.Interval%time.Hour == 0 && 24%int(sched.Interval/time.Hour) == 0:
+			n := int(sched.Interval / time.Hour)
+			if n == 1 {
+				return "0 * * * *", nil
+			}
+			return fmt.Sprintf("0 */%d * * *", n), nil
+		case sched.Interval%time.Minute == 0 && 60%int(sched.Interval/time.Minute) == 0:
+			n := int(sched.Interval / time.Minute)
+			if n == 1 {
+				return "* * * * *", nil
+			}
+			return fmt.Sprintf("*/%d * * * *", n), nil
+		}
+		return "", fmt.Errorf("interval %q cannot be represented", entry.Every)
+	case scheduleDaily:
+		return fmt.Sprintf("%d %d * * *", sched.AtMinute, sched.AtHour), nil
+	case scheduleWeekly:
+		days := make([]string, len(sched.Weekdays))
+		for i, wd := range sched.Weekdays {
+			days[i] = strconv.Itoa(int(wd))
+		}
+		return fmt.Sprintf("%d %d * * %s", sched.AtMinute, sched.AtHour, strings.Join(days, ",")), nil
+	case scheduleMonthly:
+		return fmt.Sprintf("%d %d 1 * *", sched.AtMinute, sched.AtHour), nil
+	case scheduleWatch:
+		return "", fmt.Errorf("file watch triggers cannot be represented")
+	}
+	return "", fmt.Errorf("one-time schedules cannot be represented")
+}
+
+func exportSystemd(entries []CronEntry) ([]byte, []string, error) {
+	var out bytes.Buffer
+	var warnings []string
+	for _, entry := range entries {
+		timer, err := entryTimer(entry)
+		var command string
+		if err == nil {
+			command, err = exportCommand(entry)
+		}
+		if err != nil {
+			warning := fmt.Sprintf("%s: %v, skipped", entry.Name, err)
+			warnings = append(warnings, warning)
+			fmt.Fprintf(&out, "# %s\n\n", warning)
+			continue
+		}
+		for _, ignored := range unsupportedSettings(entry, true) {
+			warnings = append(warnings, fmt.Sprintf("%s: %s is not supported, ignored", entry.Name, ignored))
+		}
+
+		unit := "aux4-cron-" + strings.Trim(unitNameRegex.ReplaceAllString(entry.Name, "-"), "-")
+		fmt.Fprintf(&out, "# %s.service\n", unit)
+		fmt.Fprintln(&out, "[Unit]")
+		fmt.Fprintf(&out, "Description=aux4 cron %s\n\n", entry.Name)
+		fmt.Fprintln(&out, "[Service]")
+		fmt.Fprintln(&out, "Type=oneshot")
+		fmt.Fprintf(&out, "ExecStart=/bin/sh -c %s\n", systemdQuote(command))
+		if entry.Workdir != "" {
+			fmt.Fprintf(&out, "WorkingDirectory=%s\n", entry.Workdir)
+		}
+		for _, key := range sortedKeys(entry.Env) {
+			fmt.Fprintf(&out, "Environment=%s\n", systemdQuote(key+"="+entry.Env[key]))
+		}
+		if entry.EnvFile != "" {
+			fmt.Fprintf(&out, "EnvironmentFile=%s\n", entry.EnvFile)
+		}
+		if entry.User != "" {
+			fmt.Fprintf(&out, "User=%s\n", entry.User)
+		}
+		if entry.Group != "" {
+			fmt.Fprintf(&out, "Group=%s\n", entry.Group)
+		}
+		if entry.Timeout != "" {
+			d, _ := parseInterval(entry.Timeout)
+			fmt.Fprintf(&out, "TimeoutStartSec=%d\n", int(d.Seconds()))
+		}
+		fmt.Fprintln(&out)
+
+		fmt.Fprintf(&out, "# %s.timer\n", unit)
+		if entry.State == "paused" {
+			fmt.Fprintln(&out, "# paused: do not enable this timer")
+		}
+		fmt.Fprintln(&out, "[Unit]")
+		fmt.Fprintf(&out, "Description=aux4 cron %s timer\n\n", entry.Name)
+		fmt.Fprintln(&out, "[Timer]")
+		fmt.Fprintln(&out, timer)
+		fmt.Fprintln(&out, "Persistent=true")
+		fmt.Fprintln(&out)
+		fmt.Fprintln(&out, "[Install]")
+		fmt.Fprintln(&out, "WantedBy=timers.target")
+		fmt.Fprintln(&out)
+	}
+	return out.Bytes(), warnings, nil
+}
+
+// entryTimer returns the [Timer] schedule settings for an entry.
+func entryTimer(entry CronEntry) (string, error) {
+	if !hasSchedule(entry) {
+		return "", fmt.Errorf("tasks that only run when triggered cannot be represented")
+	}
+	sched, err := entrySchedule(entry)
+	if err != nil {
+		return "", err
+	}
+	at := fmt.Sprintf("%02d:%02d:00", sched.AtHour, sched.AtMinute)
+	switch sched.Type {
+	case scheduleInterval:
+		seconds := int(sched.Interval.Seconds())
+		return fmt.Sprintf("OnActiveSec=%d\nOnUnitActiveSec=%d", seconds, seconds), nil
+	case scheduleDaily:
+		return "OnCalendar=*-*-* " + at, nil
+	case scheduleWeekly:
+		days := make([]string, len(sched.Weekdays))
+		for i, wd := range sched.Weekdays {
+			days[i] = wd.String()[:3]
+		}
+		return "OnCalendar=" + strings.Join(days, ",") + " *-*-* " + at, nil
+	case scheduleMonthly:
+		return "OnCalendar=*-*-01 " + at, nil
+	case scheduleWatch:
+		return "", fmt.Errorf("file watch triggers cannot be represented")
+	}
+	return "", fmt.Errorf("one-time schedules cannot be represented")
+}
+
+// unsupportedSettings lists the entry settings that are lost when exporting
+// to crontab or systemd.
+func unsupportedSettings(entry CronEntry, systemd bool) []string {
+	var settings []string
+	if entry.Max > 0 {
+		settings = append(settings, "max")
+	}
+	if entry.Retries > 0 {
+		settings = append(settings, "retries")
+	}
+	if entry.Timeout != "" && !systemd {
+		settings = append(settings, "timeout")
+	}
+	if len(entry.Notify) > 0 {
+		settings = append(settings, "notify")
+	}
+	if len(entry.OnSuccess) > 0 {
+		settings = append(settings, "onSuccess")
+	}
+	if len(entry.OnFailure) > 0 {
+		settings = append(settings, "onFailure")
+	}
+	if len(entry.After) > 0 {
+		settings = append(settings, "after")
+	}
+	if entry.Hook != nil {
+		settings = append(settings, "hook")
+	}
+	if !systemd {
+		if entry.EnvFile != "" {
+			settings = append(settings, "envFile")
+		}
+		if entry.Workdir != "" {
+			settings = append(settings, "workdir")
+		}
+		if entry.User != "" {
+			settings = append(settings, "user")
+		}
+		if entry.Group != "" {
+			settings = append(settings, "group")
+		}
+	}
+	return settings
+}
+
+// exportCommand returns the command line of an entry for crontab or
+// systemd, which cannot expand templated args.
+func exportCommand(entry CronEntry) (string, error) {
+	if len(entry.Args) == 0 {
+		return entry.Run, nil
+	}
+	if hasTemplates(entry.Args) {
+		return "", fmt.Errorf("templated args cannot be represented")
+	}
+	return joinArgs(entry.Args), nil
+}
+
+func systemdQuote(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	value = strings.ReplaceAll(value, "%", "%%")
+	value = strings.ReplaceAll(value, "$", "$$")
+	return `"` + value + `"`
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const redacted = "******"
+
+var (
+	envNameRegex   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	envSecretRegex = regexp.MustCompile(`(?i)(secret|password|passwd|token|key|credential|auth|private)`)
+	envListRegex   = regexp.MustCompile(`,\s*([A-Za-z_][A-Za-z0-9_]*)=`)
+)
+
+// parseEnvList parses a --env value: KEY=value assignments separated by
+// commas. A comma only separates assignments when a KEY= follows it, so
+// values may contain commas.
+func parseEnvList(value string) (map[string]string, error) {
+	env := make(map[string]string)
+	if strings.TrimSpace(value) == "" {
+		return env, nil
+	}
+
+	var assignments []string
+	start := 0
+	for _, loc := range envListRegex.FindAllStringIndex(value, -1) {
+		assignments = append(assignments, value[start:loc[0]])
+		start = loc[0] + 1
+	}
+	assignments = append(assignments, value[start:])
+
+	for _, assignment := range assignments {
+		key, val, ok := strings.Cut(strings.TrimSpace(assignment), "=")
+		if !ok || !envNameRegex.MatchString(key) {
+			return nil, fmt.Errorf("invalid env assignment: %s (expected KEY=value)", strings.TrimSpace(assignment))
+		}
+		env[key] = val
+	}
+	return env, nil
+}
+
+// loadEnvFile reads KEY=value lines from a dotenv style file. Blank lines,
+// comments and an "export " prefix are allowed; values may be quoted.
+func loadEnvFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	env := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || !envNameRegex.MatchString(key) {
+			return nil, fmt.Errorf("%s:%d: expected KEY=value", path, lineNumber)
+		}
+		env[key] = unquote(strings.TrimSpace(value))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// resolvePath resolves a path from an entry relative to the cron directory.
+func resolvePath(dir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// entryEnvironment returns the environment a run of the entry gets: base,
+// then the env file, then the entry's env.
+func entryEnvironment(entry CronEntry, dir string, base []string) ([]string, error) {
+	env := base
+	if entry.EnvFile != "" {
+		fileEnv, err := loadEnvFile(resolvePath(dir, entry.EnvFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load env file: %v", err)
+		}
+		env = appendEnv(env, fileEnv)
+	}
+	return appendEnv(env, entry.Env), nil
+}
+
+func appendEnv(env []string, vars map[string]string) []string {
+	for _, key := range sortedKeys(vars) {
+		env = append(env, key+"="+vars[key])
+	}
+	return env
+}
+
+func sortedKeys(vars map[string]string) []string {
+	keys := make([]string, 0, len(vars))
+	for key := range vars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// redactEntry returns a copy of the entry with its hook secret and the
+// values of secret looking env variables (tokens, passwords, keys...)
+// masked.
+func redactEntry(entry CronEntry) CronEntry {
+	if entry.Hook != nil {
+		hook := *entry.Hook
+		hook.Secret = redacted
+		entry.Hook = &hook
+	}
+	if len(entry.Env) == 0 {
+		return entry
+	}
+	env := make(map[string]string, len(entry.Env))
+	for key, value := range entry.Env {
+		if envSecretRegex.MatchString(key) {
+			value = redacted
+		}
+		env[key] = value
+	}
+	entry.Env = env
+	return entry
+}
+
+// restoreSecrets returns the entry with the secrets it was given back
+// masked, as they are read from the API or an export, set to their stored
+// values.
+func restoreSecrets(entry, stored CronEntry) CronEntry {
+	if entry.Hook != nil && entry.Hook.Secret == redacted && stored.Hook != nil {
+		hook := *entry.Hook
+		hook.Secret = stored.Hook.Secret
+		entry.Hook = &hook
+	}
+	if len(entry.Env) == 0 {
+		return entry
+	}
+	env := make(map[string]string, len(entry.Env))
+	for key, value := range entry.Env {
+		if stored, ok := stored.Env[key]; ok && value == redacted {
+			value = stored
+		}
+		env[key] = value
+	}
+	entry.Env = env
+	return entry
+}
+
+// maskedSecret returns the name of a secret of the entry that is still
+// masked, with no stored value to restore it from.
+func maskedSecret(entry CronEntry) string {
+	if entry.Hook != nil && entry.Hook.Secret == redacted {
+		return "hook secret"
+	}
+	for _, key := range sortedKeys(entry.Env) {
+		if entry.Env[key] == redacted {
+			return "env " + key
+		}
+	}
+	return ""
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	eventEntryAdded   = "entry.added"
+	eventEntryUpdated = "entry.updated"
+	eventEntryRemoved = "entry.removed"
+	eventEntryPaused  = "entry.paused"
+	eventEntryResumed = "entry.resumed"
+
+	eventRunScheduled = "run.scheduled"
+	eventRunStarted   = "run.started"
+	eventRunSucceeded = "run.succeeded"
+	eventRunFailed    = "run.failed"
+	eventRunCancelled = "run.cancelled"
+	eventRunTriggered = "run.triggered"
+	eventRunSkipped   = "run.skipped"
+
+	// eventBacklog is how many past events are kept for clients resuming
+	// a stream
+	eventBacklog = 1000
+	// eventBuffer is how many events a stream may fall behind before it is
+	// dropped; the client then resumes from the backlog
+	eventBuffer = 256
+	// eventPingInterval keeps idle streams from being closed by proxies
+	eventPingInterval = 15 * time.Second
+)
+
+// entryEvents maps the audited changes of entries to their events.
+var entryEvents = map[string]string{
+	actionAdd:    eventEntryAdded,
+	actionUpdate: eventEntryUpdated,
+	actionRemove: eventEntryRemoved,
+	actionPause:  eventEntryPaused,
+	actionResume: eventEntryResumed,
+}
+
+// Event is something that happened to an entry or a run. Ids increase
+// for the life of the scheduler and start over when it restarts.
+type Event struct {
+	ID         int64      `json:"id"`
+	Type       string     `json:"type"`
+	Timestamp  string     `json:"timestamp"`
+	Name       string     `json:"name"`
+	RunID      string     `json:"runId,omitempty"`
+	Source     string     `json:"source,omitempty"`
+	Caller     string     `json:"caller,omitempty"`
+	Planned    string     `json:"planned,omitempty"`
+	Attempt    int        `json:"attempt,omitempty"`
+	Status     string     `json:"status,omitempty"`
+	DurationMs int64      `json:"durationMs,omitempty"`
+	Reason     string     `json:"reason,omitempty"`
+	Entry      *CronEntry `json:"entry,omitempty"`
+}
+
+// EventBus hands events to the streams of /events and keeps the latest
+// ones so a client that reconnects can catch up.
+type EventBus struct {
+	mu          sync.Mutex
+	lastID      int64
+	recent      []Event
+	subscribers map[chan Event]struct{}
+	closed      bool
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[chan Event]struct{})}
+}
+
+// Publish numbers the event and sends it to every stream. A stream too far
+// behind is closed rather than blocking the scheduler.
+func (b *EventBus) Publish(event Event) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	event.ID = b.lastID
+	event.Timestamp = time.Now().UTC().Format(time.RFC3339Nano)
+	b.recent = append(b.recent, event)
+	if len(b.recent) > eventBacklog {
+		b.recent = b.recent[len(b.recent)-eventBacklog:]
+	}
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe returns the kept events after the given id, and a channel of
+// the events to come. A negative id starts from now; an id ahead of the
+// last event comes from before a restart, so everything kept is replayed.
+// cancel must be called once the stream ends.
+func (b *EventBus) Subscribe(after int64) ([]Event, <-chan Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if after < 0 {
+		after = b.lastID
+	} else if after > b.lastID {
+		after = 0
+	}
+	var backlog []Event
+	for _, event := range b.recent {
+		if event.ID > after {
+			backlog = append(backlog, event)
+		}
+	}
+
+	ch := make(chan Event, eventBuffer)
+	if b.closed {
+		close(ch)
+		return backlog, ch, func() {}
+	}
+	b.subscribers[ch] = struct{}{}
+	cancel := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subscribers[ch]; ok {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+	return backlog, ch, cancel
+}
+
+// Close ends every stream, so the server can shut down.
+func (b *EventBus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for ch := range b.subscribers {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// eventFilter selects events by entry name and by type, where a type
+// without a dot, like run, matches all of its kind.
+type eventFilter struct {
+	name  string
+	types []string
+}
+
+func (f eventFilter) match(event Event) bool {
+	if f.name != "" && event.Name != f.name {
+		return false
+	}
+	if len(f.types) == 0 {
+		return true
+	}
+	for _, t := range f.types {
+		if event.Type == t || strings.HasPrefix(event.Type, t+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// serveEvents streams events as Server-Sent Events from now on. A client
+// resumes after the id in its Last-Event-ID header, or in the lastEventId
+// parameter.
+func serveEvents(w http.ResponseWriter, r *http.Request, bus *EventBus) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("lastEventId")
+	}
+	after := int64(-1)
+	if lastID != "" {
+		n, err := strconv.ParseInt(lastID, 10, 64)
+		if err != nil || n < 0 {
+			httpError(w, http.StatusBadRequest, "last event id must be a non-negative integer")
+			return
+		}
+		after = n
+	}
+	filter := eventFilter{name: r.URL.Query().Get("name"), types: splitList(r.URL.Query().Get("type"))}
+
+	backlog, events, cancel := bus.Subscribe(after)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(event Event) error {
+		if !filter.match(event) {
+			return nil
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+		return err
+	}
+
+	for _, event := range backlog {
+		if err := send(event); err != nil {
+			return
+		}
+	}
+	// A comment opens the stream even when nothing is sent yet
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	ping := time.NewTicker(eventPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ping.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := send(event); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// runEvent returns the event reporting how a run ended. Only final
+// statuses succeed or fail: a run left TRIGGERED started its job without
+// learning how the job ended.
+func runEvent(record HistoryEntry) string {
+	switch {
+	case record.Status == "CANCELLED":
+		return eventRunCancelled
+	case isPendingStatus(record.Status):
+		return eventRunTriggered
+	case isFailureStatus(record.Status):
+		return eventRunFailed
+	}
+	return eventRunSucceeded
+}
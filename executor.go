@@ -0,0 +1,621 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// retryDelay is the wait before the first retry of a failed run; later
+// retries wait proportionally longer.
+const retryDelay = 5 * time.Second
+
+// killGracePeriod is how long a timed out command may take to exit after
+// SIGTERM before its process group is killed.
+const killGracePeriod = 10 * time.Second
+
+const (
+	defaultConcurrency = 4
+	runQueueSize       = 256
+)
+
+const (
+	sourceSchedule = "schedule"
+	// sourceCatchUp is a scheduled fire that started late, after the
+	// scheduler was stopped or the host was asleep
+	sourceCatchUp = "catch-up"
+	sourceManual  = "manual"
+)
+
+// runRequest is a fire of an entry waiting for a worker.
+type runRequest struct {
+	entry   CronEntry
+	planned time.Time
+	source  string
+	// upstream is the run that triggered this one through a dependency
+	upstream string
+	// files are the paths that triggered a watch entry
+	files []string
+	// runID is set when the caller needs the id of the run up front
+	runID string
+	// hook is the webhook call that triggered the run
+	hook *hookInput
+	// last marks the final fire of an entry with a run limit, which is
+	// removed once the run finished
+	last bool
+}
+
+// Run is an execution in progress. Retries of a fire share the same run.
+type Run struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	PID       int    `json:"pid,omitempty"`
+	StartedAt string `json:"startedAt"`
+	Source    string `json:"source"`
+	Attempt   int    `json:"attempt"`
+
+	cancel context.CancelFunc
+}
+
+// runContext describes an attempt to the command it runs.
+type runContext struct {
+	runID    string
+	attempt  int
+	planned  time.Time
+	fired    time.Time
+	source   string
+	previous string
+	upstream string
+	files    []string
+	hook     *hookInput
+}
+
+// environ returns the CRON_* variables injected into the command.
+func (rc runContext) environ(name string) []string {
+	env := []string{
+		"CRON_NAME=" + name,
+		"CRON_RUN_ID=" + rc.runID,
+		"CRON_SCHEDULED_AT=" + rc.planned.UTC().Format(time.RFC3339),
+		"CRON_FIRED_AT=" + rc.fired.UTC().Format(time.RFC3339),
+		"CRON_ATTEMPT=" + strconv.Itoa(rc.attempt),
+		"CRON_TRIGGER=" + rc.source,
+		"CRON_PREVIOUS_STATUS=" + rc.previous,
+		"CRON_UPSTREAM_RUN_ID=" + rc.upstream,
+	}
+	env = append(env, filesEnviron(rc.files)...)
+	return append(env, rc.hook.environ()...)
+}
+
+func newRunID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Running returns the executions in progress, oldest first.
+func (s *Scheduler) Running() []Run {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make([]Run, 0, len(s.runs))
+	for _, run := range s.runs {
+		result = append(result, *run)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].StartedAt < result[j].StartedAt })
+	return result
+}
+
+// Kill cancels a running execution. Its process group is terminated and the
+// run is recorded as CANCELLED.
+func (s *Scheduler) Kill(id string) (*Run, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	run, ok := s.runs[id]
+	if !ok {
+		return nil, errRunNotFound(id)
+	}
+	run.cancel()
+	result := *run
+	return &result, nil
+}
+
+// DrainResult describes how the runs in progress ended on shutdown.
+type DrainResult struct {
+	Drained   bool `json:"drained"`
+	Completed int  `json:"completed"`
+	Cancelled int  `json:"cancelled"`
+	Dropped   int  `json:"dropped"`
+}
+
+// Drain stops firing entries and waits up to timeout for the runs in
+// progress to finish. Fires still waiting in the queue are dropped, and runs
+// still going after the timeout are cancelled so that their history is
+// recorded before the workers stop.
+func (s *Scheduler) Drain(timeout time.Duration) DrainResult {
+	s.Stop()
+
+	result := DrainResult{Dropped: s.dropQueued()}
+
+	pending := s.pending()
+	if s.waitIdle(timeout) {
+		result.Drained = true
+		result.Completed = pending
+	} else {
+		s.mu.Lock()
+		for _, run := range s.runs {
+			run.cancel()
+			result.Cancelled++
+		}
+		s.mu.Unlock()
+		result.Completed = pending - result.Cancelled
+		s.waitIdle(killGracePeriod + time.Second)
+	}
+
+	s.mu.Lock()
+	if s.workerStop != nil {
+		close(s.workerStop)
+		s.workerStop = nil
+	}
+	s.mu.Unlock()
+
+	// Workers stopping may leave fires behind; they are not run
+	result.Dropped += s.dropQueued()
+	return result
+}
+
+// dropQueued empties the queue and releases the entries of the fires in it.
+func (s *Scheduler) dropQueued() int {
+	dropped := 0
+	for {
+		select {
+		case req := <-s.queue:
+			s.done(req.entry.Name)
+			dropped++
+		default:
+			return dropped
+		}
+	}
+}
+
+func (s *Scheduler) pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.inFlight)
+}
+
+// waitIdle waits until no run is in flight, up to timeout.
+func (s *Scheduler) waitIdle(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for s.pending() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+func (s *Scheduler) setRunPID(id string, attempt, pid int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if run, ok := s.runs[id]; ok {
+		run.PID = pid
+		run.Attempt = attempt
+	}
+}
+
+// enqueue hands a fire over to the worker pool without blocking the
+// schedule goroutine. An entry is never run twice at once: a fire while the
+// previous run is still queued or going is skipped and reported as missed,
+// as is a fire when the queue is full. Once the scheduler stops, fires are
+// refused so that a drain only waits for runs already accepted.
+func (s *Scheduler) enqueue(req runRequest) bool {
+	name := req.entry.Name
+	if req.runID == "" {
+		req.runID = newRunID()
+	}
+
+	// The queue is filled under the lock so that Drain, which stops the
+	// scheduler first, sees every accepted fire
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		fmt.Fprintf(defaultStderr, "cron %s: not run, scheduler is shutting down\n", name)
+		s.events.Publish(Event{Type: eventRunSkipped, Name: name, Source: req.source, Reason: "scheduler is shutting down"})
+		return false
+	}
+	if _, busy := s.inFlight[name]; busy {
+		s.mu.Unlock()
+		s.skipped(req, "previous run still in progress")
+		return false
+	}
+	select {
+	case s.queue <- req:
+		s.inFlight[name] = time.Now()
+		s.mu.Unlock()
+	default:
+		s.mu.Unlock()
+		s.skipped(req, "run queue is full")
+		return false
+	}
+
+	s.events.Publish(Event{
+		Type:    eventRunScheduled,
+		Name:    name,
+		RunID:   req.runID,
+		Source:  req.source,
+		Planned: req.planned.UTC().Format(time.RFC3339Nano),
+	})
+	return true
+}
+
+// queueNow queues a run outside the entry's schedule and returns its run id.
+func (s *Scheduler) queueNow(req runRequest) (string, error) {
+	s.mu.Lock()
+	running := s.running
+	s.mu.Unlock()
+	if !running {
+		return "", errNotRunning()
+	}
+
+	req.runID = newRunID()
+	if !s.enqueue(req) {
+		return "", errRunNotQueued(req.entry.Name)
+	}
+	return req.runID, nil
+}
+
+// Run queues a run of the entry now, as asked for by an operator, and
+// returns its run id.
+func (s *Scheduler) Run(entry CronEntry) (string, error) {
+	return s.queueNow(runRequest{entry: entry, planned: time.Now(), source: sourceManual})
+}
+
+// skipped reports a fire that was not run.
+func (s *Scheduler) skipped(req runRequest, reason string) {
+	s.missed(req.entry, 1, reason)
+	s.events.Publish(Event{Type: eventRunSkipped, Name: req.entry.Name, Source: req.source, Reason: reason})
+}
+
+func (s *Scheduler) done(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.inFlight, name)
+}
+
+func (s *Scheduler) worker(stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case req := <-s.queue:
+			s.trigger(req)
+			s.done(req.entry.Name)
+		}
+	}
+}
+
+func (s *Scheduler) trigger(req runRequest) {
+	entry := req.entry
+	name := entry.Name
+	previous := s.store.LastStatus(name)
+	timeout := s.timeoutFor(entry)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fired := time.Now()
+	runID := req.runID
+	if runID == "" {
+		runID = newRunID()
+	}
+	run := &Run{
+		ID:        runID,
+		Name:      name,
+		StartedAt: fired.UTC().Format(time.RFC3339Nano),
+		Source:    req.source,
+		cancel:    cancel,
+	}
+	s.mu.Lock()
+	s.runs[run.ID] = run
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.runs, run.ID)
+		s.mu.Unlock()
+	}()
+
+	attempts := entry.Retries + 1
+	var record HistoryEntry
+	var output string
+	for attempt := 1; attempt <= attempts; attempt++ {
+		rc := runContext{
+			runID:    run.ID,
+			attempt:  attempt,
+			planned:  req.planned,
+			fired:    fired,
+			source:   req.source,
+			previous: previous,
+			upstream: req.upstream,
+			files:    req.files,
+			hook:     req.hook,
+		}
+		started := Event{Type: eventRunStarted, Name: name, RunID: run.ID, Source: req.source}
+		if entry.Retries > 0 {
+			started.Attempt = attempt
+		}
+		s.events.Publish(started)
+		record, output = s.runAttempt(ctx, entry, rc, timeout)
+
+		if !isFailureStatus(record.Status) || attempt == attempts {
+			break
+		}
+		fmt.Fprintf(defaultStderr, "cron %s: retrying (attempt %d of %d)\n", name, attempt+1, attempts)
+		select {
+		case <-ctx.Done():
+		case <-time.After(retryDelay * time.Duration(attempt)):
+		}
+		if ctx.Err() != nil {
+			record = HistoryEntry{
+				Name:          name,
+				RunID:         run.ID,
+				UpstreamRunID: req.upstream,
+				Files:         req.files,
+				Timestamp:     time.Now().UTC().Format(time.RFC3339),
+				Status:        "CANCELLED",
+				Attempt:       attempt + 1,
+			}
+			if req.hook != nil {
+				record.Caller = req.hook.Caller
+				record.SourceIP = req.hook.SourceIP
+			}
+			if _, histErr := s.store.AddHistory(record); histErr != nil {
+				fmt.Fprintf(defaultStderr, "cron %s: failed to save history: %v\n", name, histErr)
+			}
+			break
+		}
+	}
+
+	s.events.Publish(Event{
+		Type:       runEvent(record),
+		Name:       name,
+		RunID:      run.ID,
+		Source:     req.source,
+		Attempt:    record.Attempt,
+		Status:     record.Status,
+		DurationMs: time.Since(fired).Milliseconds(),
+	})
+
+	event := ""
+	if record.Status == "CANCELLED" {
+		// Cancelled by an operator, nothing to notify
+	} else if isFailureStatus(record.Status) {
+		event = eventFailure
+		if entry.Retries > 0 {
+			event = eventRetriesExhausted
+		}
+	} else if isFailureStatus(previous) {
+		event = eventRecovery
+	}
+	if event != "" {
+		s.notifier.Notify(entry, Notification{
+			Event:     event,
+			Timestamp: time.Now().UTC().Format(time.RFC3339),
+			Entry:     entry,
+			History:   &record,
+			Output:    output,
+		})
+	}
+
+	s.chain(entry, record.Status, run.ID)
+
+	if req.last {
+		s.autoRemove(name)
+	}
+}
+
+// runAttempt runs one attempt and records it in history. When the job it
+// started is tracked, the attempt lasts until the job finishes: the record
+// is saved as TRIGGERED first and updated with the job's final status.
+func (s *Scheduler) runAttempt(ctx context.Context, entry CronEntry, rc runContext, timeout time.Duration) (HistoryEntry, string) {
+	name := entry.Name
+	start := time.Now()
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	record, output := s.execute(ctx, entry, rc, timeout)
+	record.RunID = rc.runID
+	record.UpstreamRunID = rc.upstream
+	record.Files = rc.files
+	if rc.hook != nil {
+		record.Caller = rc.hook.Caller
+		record.SourceIP = rc.hook.SourceIP
+	}
+	if entry.Retries > 0 {
+		record.Attempt = rc.attempt
+	}
+
+	id, err := s.store.AddHistory(record)
+	if err != nil {
+		fmt.Fprintf(defaultStderr, "cron %s: failed to save history: %v\n", name, err)
+	}
+
+	if s.tracker != nil && record.Status == "TRIGGERED" && record.JobID != "" {
+		record.ID = id
+		state, err := s.tracker.Wait(ctx, record.JobID)
+		switch {
+		case errors.Is(err, context.Canceled):
+			s.stopJob(name, record.JobID)
+			record.Status = "CANCELLED"
+		case errors.Is(err, context.DeadlineExceeded):
+			s.stopJob(name, record.JobID)
+			record.Status = "TIMEOUT"
+			fmt.Fprintf(defaultStderr, "cron %s: timed out after %s, job %s killed\n", name, timeout, record.JobID)
+		case err != nil:
+			fmt.Fprintf(defaultStderr, "cron %s: stopped tracking job %s: %v\n", name, record.JobID, err)
+		default:
+			record.Status = state.Status
+			record.ExitCode = state.ExitCode
+		}
+		record.DurationMs = time.Since(start).Milliseconds()
+		if err := s.store.UpdateHistory(record); err != nil {
+			fmt.Fprintf(defaultStderr, "cron %s: failed to save history: %v\n", name, err)
+		}
+	}
+
+	s.metrics.ObserveTrigger(name, record.Status, time.Since(start))
+	// Retries start late on purpose; only the first attempt shows the lag
+	if rc.attempt == 1 {
+		s.metrics.ObserveLag(name, start.Sub(rc.planned))
+	}
+	return record, output
+}
+
+// stopJob kills the aux4/jobs job of a run that was cancelled or timed out.
+func (s *Scheduler) stopJob(name, jobID string) {
+	if err := s.tracker.Stop(jobID); err != nil {
+		fmt.Fprintf(defaultStderr, "cron %s: failed to stop job %s: %v\n", name, jobID, err)
+	}
+}
+
+// execute starts the command through aux4/jobs and returns its history
+// record along with an excerpt of its output.
+func (s *Scheduler) execute(ctx context.Context, entry CronEntry, rc runContext, timeout time.Duration) (HistoryEntry, string) {
+	name := entry.Name
+	start := time.Now()
+	now := start.UTC().Format(time.RFC3339)
+
+	jobID := ""
+	status := "TRIGGERED"
+
+	command, err := entryCommand(entry, rc)
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("aux4", "jobs", "run", command)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Dir = resolvePath(s.store.dir, entry.Workdir)
+	setProcessGroup(cmd)
+
+	if err == nil {
+		err = s.prepareCommand(cmd, entry, rc)
+	}
+	if err == nil {
+		err = runWithContext(ctx, cmd, func(pid int) {
+			s.setRunPID(rc.runID, rc.attempt, pid)
+		})
+	}
+	output := stdout.Bytes()
+	if errors.Is(err, context.Canceled) {
+		status = "CANCELLED"
+		fmt.Fprintf(defaultStderr, "cron %s: run %s cancelled\n", name, rc.runID)
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		status = "TIMEOUT"
+		fmt.Fprintf(defaultStderr, "cron %s: timed out after %s\n", name, timeout)
+	} else if err != nil {
+		status = "FAILED"
+		fmt.Fprintf(defaultStderr, "cron %s: failed to run job: %v\n", name, err)
+	} else {
+		var result map[string]interface{}
+		if jsonErr := json.Unmarshal(output, &result); jsonErr == nil {
+			if id, ok := result["id"]; ok {
+				jobID = fmt.Sprintf("%v", id)
+			}
+		}
+	}
+
+	duration := time.Since(start)
+	record := HistoryEntry{
+		Name:       name,
+		JobID:      jobID,
+		Timestamp:  now,
+		Status:     status,
+		DurationMs: duration.Milliseconds(),
+	}
+	return record, excerpt(string(output) + stderr.String())
+}
+
+// prepareCommand sets the environment and the user the entry runs with.
+// The CRON_* run context comes last so the entry cannot override it.
+func (s *Scheduler) prepareCommand(cmd *exec.Cmd, entry CronEntry, rc runContext) error {
+	base := os.Environ()
+	if entry.User != "" || entry.Group != "" {
+		userEnv, err := runAs(cmd, entry.User, entry.Group)
+		if err != nil {
+			return err
+		}
+		base = append(base, userEnv...)
+	}
+	env, err := entryEnvironment(entry, s.store.dir, base)
+	if err != nil {
+		return err
+	}
+	cmd.Env = append(env, rc.environ(entry.Name)...)
+	return nil
+}
+
+// runWithContext runs the command until it exits or ctx is done. On
+// cancellation the command's process group gets SIGTERM and, if still
+// running after killGracePeriod, SIGKILL.
+func runWithContext(ctx context.Context, cmd *exec.Cmd, started func(pid int)) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	started(cmd.Process.Pid)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	terminateProcessGroup(cmd)
+	select {
+	case <-done:
+	case <-time.After(killGracePeriod):
+		killProcessGroup(cmd)
+		<-done
+	}
+	return ctx.Err()
+}
+
+// timeoutFor returns the entry's own timeout or the scheduler default.
+func (s *Scheduler) timeoutFor(entry CronEntry) time.Duration {
+	if entry.Timeout != "" {
+		if d, err := parseInterval(entry.Timeout); err == nil {
+			return d
+		}
+	}
+	return s.defaultTimeout
+}
+
+// missed reports runs that did not happen at their planned time.
+func (s *Scheduler) missed(entry CronEntry, count int, reason string) {
+	fmt.Fprintf(defaultStderr, "cron %s: missed %d run(s): %s\n", entry.Name, count, reason)
+	s.notifier.Notify(entry, Notification{
+		Event:     eventMissed,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Entry:     entry,
+		Missed:    count,
+	})
+}
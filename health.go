@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// maxTickAge is how long the scheduler heartbeat may be silent before the
+// scheduler is reported as not ready.
+const maxTickAge = 5 * time.Second
+
+type HealthReport struct {
+	Status          string   `json:"status"`
+	Version         string   `json:"version"`
+	PID             int      `json:"pid"`
+	StartedAt       string   `json:"startedAt"`
+	Uptime          string   `json:"uptime"`
+	StoreLoaded     bool     `json:"storeLoaded"`
+	HistoryWritable bool     `json:"historyWritable"`
+	MissingTimers   []string `json:"missingTimers"`
+	LastTickAgeMs   int64    `json:"lastTickAgeMs"`
+}
+
+func checkHealth(store *CronStore, scheduler *Scheduler, started time.Time) HealthReport {
+	report := HealthReport{
+		Status:          "OK",
+		Version:         version,
+		PID:             os.Getpid(),
+		StartedAt:       started.UTC().Format(time.RFC3339),
+		Uptime:          time.Since(started).Truncate(time.Second).String(),
+		StoreLoaded:     store.Loaded(),
+		HistoryWritable: store.HistoryWritable(),
+		MissingTimers:   []string{},
+	}
+
+	for _, e := range store.List() {
+		if e.State == "active" && hasSchedule(e) && !scheduler.HasTimer(e.Name) {
+			report.MissingTimers = append(report.MissingTimers, e.Name)
+		}
+	}
+
+	age := time.Since(scheduler.LastTick())
+	report.LastTickAgeMs = age.Milliseconds()
+
+	if !report.StoreLoaded || !report.HistoryWritable || len(report.MissingTimers) > 0 || age > maxTickAge {
+		report.Status = "DEGRADED"
+	}
+	return report
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sourceHook = "hook"
+
+	// hookMaxBody is the largest request body passed to a hook's command
+	hookMaxBody = 64 << 10
+	// hookRateWindow is the period a hook's rate applies to
+	hookRateWindow = time.Minute
+)
+
+// EntryHook lets an entry be triggered over HTTP by POST /hooks/<name>.
+type EntryHook struct {
+	// Secret authenticates callers: sent as a bearer token, or used to sign
+	// the request body with HMAC-SHA256
+	Secret string `json:"secret"`
+	// Rate is how many calls a minute are accepted, unlimited when 0
+	Rate int `json:"rate,omitempty"`
+}
+
+// hookInput is what a webhook call passes to the run it triggers.
+type hookInput struct {
+	Body     string
+	Query    string
+	Caller   string
+	SourceIP string
+}
+
+// environ returns the variables passing the call to the command.
+func (in *hookInput) environ() []string {
+	if in == nil {
+		return nil
+	}
+	return []string{
+		"CRON_INPUT=" + in.Body,
+		"CRON_QUERY=" + in.Query,
+		"CRON_CALLER=" + in.Caller,
+	}
+}
+
+// authorizeHook checks the credentials of a webhook call: the secret as a
+// bearer token or X-Cron-Token header, or an HMAC-SHA256 signature of the
+// body as X-Cron-Signature (or GitHub's X-Hub-Signature-256), "sha256=<hex>".
+func authorizeHook(r *http.Request, body []byte, secret string) bool {
+	token := r.Header.Get("X-Cron-Token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token != "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+	}
+
+	signature := r.Header.Get("X-Cron-Signature")
+	if signature == "" {
+		signature = r.Header.Get("X-Hub-Signature-256")
+	}
+	given, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if signature == "" || err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(given, mac.Sum(nil))
+}
+
+// hookCaller names who called a hook: the X-Cron-Caller header, or the
+// user agent.
+func hookCaller(r *http.Request) string {
+	if caller := r.Header.Get("X-Cron-Caller"); caller != "" {
+		return caller
+	}
+	return r.UserAgent()
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// hookLimiter counts the calls of each hook over a sliding window.
+type hookLimiter struct {
+	mu    sync.Mutex
+	calls map[string][]time.Time
+}
+
+func newHookLimiter() *hookLimiter {
+	return &hookLimiter{calls: make(map[string][]time.Time)}
+}
+
+// allow records a call of the hook unless rate calls were already accepted
+// within the window, in which case it returns how long to wait.
+func (l *hookLimiter) allow(name string, rate int, now time.Time) (bool, time.Duration) {
+	if rate <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cutoff := now.Add(-hookRateWindow)
+	calls := l.calls[name]
+	for len(calls) > 0 && !calls[0].After(cutoff) {
+		calls = calls[1:]
+	}
+	if len(calls) >= rate {
+		l.calls[name] = calls
+		return false, calls[0].Sub(cutoff)
+	}
+	l.calls[name] = append(calls, now)
+	return true, 0
+}
+
+// Hook queues a run of the entry for a webhook call and returns its run id.
+func (s *Scheduler) Hook(entry CronEntry, input *hookInput) (string, error) {
+	return s.queueNow(runRequest{entry: entry, planned: time.Now(), source: sourceHook, hook: input})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	// jobPollInterval is how often aux4/jobs is asked about a running job
+	jobPollInterval = 2 * time.Second
+	// jobStatusAttempts is how many status checks in a row may fail before
+	// the job is no longer tracked
+	jobStatusAttempts = 5
+	// jobResumeWindow is how old a run may be for its job to be tracked
+	// again after a restart
+	jobResumeWindow = 24 * time.Hour
+)
+
+// jobState is what aux4/jobs reports about a job.
+type jobState struct {
+	Done     bool
+	Status   string
+	ExitCode *int
+}
+
+// JobTracker follows jobs started through aux4/jobs until they finish.
+type JobTracker struct {
+	interval time.Duration
+	attempts int
+	status   func(jobID string) (jobState, error)
+	kill     func(jobID string) error
+}
+
+func NewJobTracker() *JobTracker {
+	return &JobTracker{
+		interval: jobPollInterval,
+		attempts: jobStatusAttempts,
+		status:   jobStatus,
+		kill:     killJob,
+	}
+}
+
+// Wait polls the job until it finishes or ctx is done. It gives up when
+// the status of the job cannot be read several times in a row, or at once
+// when the status is not one aux4/jobs reports.
+func (t *JobTracker) Wait(ctx context.Context, jobID string) (jobState, error) {
+	failures := 0
+	for {
+		state, err := t.status(jobID)
+		if err == nil && state.Done {
+			return state, nil
+		}
+		if errors.Is(err, errJobStatus) {
+			return jobState{}, err
+		}
+		if err != nil {
+			failures++
+			if failures >= t.attempts {
+				return jobState{}, err
+			}
+		} else {
+			failures = 0
+		}
+
+		select {
+		case <-ctx.Done():
+			return jobState{}, ctx.Err()
+		case <-time.After(t.interval):
+		}
+	}
+}
+
+// Stop kills a job whose run was cancelled or timed out while it was
+// tracked.
+func (t *JobTracker) Stop(jobID string) error {
+	return t.kill(jobID)
+}
+
+// Resume tracks again the jobs of recent runs that were still going when
+// the scheduler stopped, and records how they ended.
+func (t *JobTracker) Resume(store *CronStore) {
+	cutoff := time.Now().Add(-jobResumeWindow)
+	for _, h := range store.PendingJobs(cutoff) {
+		go func(h HistoryEntry) {
+			state, err := t.Wait(context.Background(), h.JobID)
+			if err != nil {
+				fmt.Fprintf(defaultStderr, "cron %s: stopped tracking job %s: %v\n", h.Name, h.JobID, err)
+				return
+			}
+			h.Status = state.Status
+			h.ExitCode = state.ExitCode
+			// The job is seen finished at the latest poll, so this may be
+			// up to an interval longer than it ran
+			if started, err := time.Parse(time.RFC3339, h.Timestamp); err == nil {
+				h.DurationMs = time.Since(started).Milliseconds()
+			}
+			if err := store.UpdateHistory(h); err != nil {
+				fmt.Fprintf(defaultStderr, "cron %s: failed to save history: %v\n", h.Name, err)
+			}
+		}(h)
+	}
+}
+
+// jobStatus asks aux4/jobs for the state of a job.
+func jobStatus(jobID string) (jobState, error) {
+	output, err := exec.Command("aux4", "jobs", "status", jobID).Output()
+	if err != nil {
+		return jobState{}, fmt.Errorf("aux4 jobs status: %v", err)
+	}
+	return parseJobStatus(output)
+}
+
+// killJob asks aux4/jobs to stop a job.
+func killJob(jobID string) error {
+	if output, err := exec.Command("aux4", "jobs", "kill", jobID).CombinedOutput(); err != nil {
+		return fmt.Errorf("aux4 jobs kill: %v: %s", err, strings.TrimSpace(excerpt(string(output))))
+	}
+	return nil
+}
+
+// jobStatusOutput is the JSON printed by "aux4 jobs status <jobId>", e.g.
+// {"id": "...", "status": "completed", "exitCode": 0}. The exit code is set
+// once the job exited.
+type jobStatusOutput struct {
+	Status   string `json:"status"`
+	ExitCode *int   `json:"exitCode"`
+}
+
+const (
+	jobRunning   = "running"
+	jobCompleted = "completed"
+	jobFailed    = "failed"
+)
+
+// errJobStatus is returned for output of "aux4 jobs status" that does not
+// follow its format. Polling again would not help, so tracking stops.
+var errJobStatus = errors.New("invalid job status")
+
+// parseJobStatus reads the output of "aux4 jobs status". A completed job
+// succeeded when it exited with 0; a failed job could not run or exit.
+func parseJobStatus(output []byte) (jobState, error) {
+	var result jobStatusOutput
+	if err := json.Unmarshal(output, &result); err != nil {
+		return jobState{}, fmt.Errorf("%w: %s", errJobStatus, strings.TrimSpace(excerpt(string(output))))
+	}
+
+	switch result.Status {
+	case jobRunning:
+		return jobState{}, nil
+	case jobCompleted:
+		if result.ExitCode == nil {
+			return jobState{}, fmt.Errorf("%w: completed without an exit code", errJobStatus)
+		}
+		state := jobState{Done: true, Status: "SUCCESS", ExitCode: result.ExitCode}
+		if *result.ExitCode != 0 {
+			state.Status = "FAILED"
+		}
+		return state, nil
+	case jobFailed:
+		return jobState{Done: true, Status: "FAILED", ExitCode: result.ExitCode}, nil
+	}
+	return jobState{}, fmt.Errorf("%w: unknown status %q", errJobStatus, result.Status)
+}
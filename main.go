@@ -31,6 +31,42 @@ func main() {
 		listEntries(args)
 	case "history":
 		showHistory(args)
+	case "stats":
+		showStats(args)
+	case "audit":
+		showAudit(args)
+	case "watch":
+		watchEvents(args)
+	case "status":
+		showStatus(args)
+	case "apply":
+		applyManifest(args)
+	case "import":
+		importCrontab(args)
+	case "export":
+		exportEntries(args)
+	case "graph":
+		showGraph(args)
+	case "ps":
+		listRunning(args)
+	case "kill":
+		killRun(args)
+	case "run":
+		runEntry(args)
+	case "notify-test":
+		testNotify(args)
+	case "token":
+		switch getArg(args, 0, "") {
+		case "create":
+			createToken(args[1:])
+		case "list":
+			listTokens(args[1:])
+		case "revoke":
+			revokeToken(args[1:])
+		default:
+			fmt.Fprintln(os.Stderr, "usage: aux4-cron token create|list|revoke [args...]")
+			os.Exit(1)
+		}
 	default:
 		fmt.Fprintf(os.Stderr, "unknown command: %s\n", cmd)
 		os.Exit(1)
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var version = "dev"
+
+var (
+	durationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 900}
+	lagBuckets      = []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 30, 60}
+)
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+type triggerKey struct {
+	name   string
+	status string
+}
+
+// Metrics collects scheduler activity and renders it in the Prometheus
+// text exposition format.
+type Metrics struct {
+	mu       sync.Mutex
+	started  time.Time
+	triggers map[triggerKey]uint64
+	duration map[string]*histogram
+	lag      map[string]*histogram
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		started:  time.Now(),
+		triggers: make(map[triggerKey]uint64),
+		duration: make(map[string]*histogram),
+		lag:      make(map[string]*histogram),
+	}
+}
+
+func (m *Metrics) ObserveTrigger(name, status string, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.triggers[triggerKey{name, status}]++
+
+	if _, ok := m.duration[name]; !ok {
+		m.duration[name] = newHistogram(durationBuckets)
+	}
+	m.duration[name].observe(duration.Seconds())
+}
+
+// ObserveLag records how late a fire started after its planned time.
+func (m *Metrics) ObserveLag(name string, lag time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if lag < 0 {
+		lag = 0
+	}
+	if _, ok := m.lag[name]; !ok {
+		m.lag[name] = newHistogram(lagBuckets)
+	}
+	m.lag[name].observe(lag.Seconds())
+}
+
+func (m *Metrics) Write(w io.Writer, entries []CronEntry, nextFires map[string]time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP aux4_cron_triggers_total Executions triggered by entry and status.")
+	fmt.Fprintln(w, "# TYPE aux4_cron_triggers_total counter")
+	keys := make([]triggerKey, 0, len(m.triggers))
+	for k := range m.triggers {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		return keys[i].status < keys[j].status
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "aux4_cron_triggers_total{name=\"%s\",status=\"%s\"} %d\n", escapeLabel(k.name), escapeLabel(k.status), m.triggers[k])
+	}
+
+	writeHistograms(w, "aux4_cron_run_duration_seconds", "Duration of executions in seconds.", m.duration)
+	writeHistograms(w, "aux4_cron_schedule_lag_seconds", "Delay between the planned and actual fire time in seconds.", m.lag)
+
+	active, paused := 0, 0
+	for _, e := range entries {
+		if e.State == "active" {
+			active++
+		} else if e.State == "paused" {
+			paused++
+		}
+	}
+	fmt.Fprintln(w, "# HELP aux4_cron_entries Cron entries by state.")
+	fmt.Fprintln(w, "# TYPE aux4_cron_entries gauge")
+	fmt.Fprintf(w, "aux4_cron_entries{state=\"active\"} %d\n", active)
+	fmt.Fprintf(w, "aux4_cron_entries{state=\"paused\"} %d\n", paused)
+
+	fmt.Fprintln(w, "# HELP aux4_cron_next_fire_timestamp_seconds Unix time of the next planned fire per entry.")
+	fmt.Fprintln(w, "# TYPE aux4_cron_next_fire_timestamp_seconds gauge")
+	names := make([]string, 0, len(nextFires))
+	for name := range nextFires {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "aux4_cron_next_fire_timestamp_seconds{name=\"%s\"} %d\n", escapeLabel(name), nextFires[name].Unix())
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	fmt.Fprintln(w, "# HELP aux4_cron_build_info Build information.")
+	fmt.Fprintln(w, "# TYPE aux4_cron_build_info gauge")
+	fmt.Fprintf(w, "aux4_cron_build_info{version=\"%s\",goversion=\"%s\"} 1\n", escapeLabel(version), runtime.Version())
+	fmt.Fprintln(w, "# HELP process_start_time_seconds Start time of the process since unix epoch in seconds.")
+	fmt.Fprintln(w, "# TYPE process_start_time_seconds gauge")
+	fmt.Fprintf(w, "process_start_time_seconds %d\n", m.started.Unix())
+	fmt.Fprintln(w, "# HELP process_pid Process id of the scheduler.")
+	fmt.Fprintln(w, "# TYPE process_pid gauge")
+	fmt.Fprintf(w, "process_pid %d\n", os.Getpid())
+	fmt.Fprintln(w, "# HELP go_goroutines Number of goroutines that currently exist.")
+	fmt.Fprintln(w, "# TYPE go_goroutines gauge")
+	fmt.Fprintf(w, "go_goroutines %d\n", runtime.NumGoroutine())
+	fmt.Fprintln(w, "# HELP go_memstats_alloc_bytes Number of bytes allocated and still in use.")
+	fmt.Fprintln(w, "# TYPE go_memstats_alloc_bytes gauge")
+	fmt.Fprintf(w, "go_memstats_alloc_bytes %d\n", mem.Alloc)
+	fmt.Fprintln(w, "# HELP go_memstats_sys_bytes Number of bytes obtained from the system.")
+	fmt.Fprintln(w, "# TYPE go_memstats_sys_bytes gauge")
+	fmt.Fprintf(w, "go_memstats_sys_bytes %d\n", mem.Sys)
+}
+
+func writeHistograms(w io.Writer, metric, help string, byName map[string]*histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n", metric, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", metric)
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		h := byName[name]
+		label := escapeLabel(name)
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{name=\"%s\",le=\"%g\"} %d\n", metric, label, b, h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{name=\"%s\",le=\"+Inf\"} %d\n", metric, label, h.count)
+		fmt.Fprintf(w, "%s_sum{name=\"%s\"} %g\n", metric, label, h.sum)
+		fmt.Fprintf(w, "%s_count{name=\"%s\"} %d\n", metric, label, h.count)
+	}
+}
+
+func escapeLabel(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return strings.ReplaceAll(value, "\n", `\n`)
+}
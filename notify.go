@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	eventFailure          = "failure"
+	eventRecovery         = "recovery"
+	eventRetriesExhausted = "retries_exhausted"
+	eventMissed           = "missed"
+	eventTest             = "test"
+)
+
+var notifyEvents = []string{eventFailure, eventRecovery, eventRetriesExhausted, eventMissed}
+
+// outputExcerptSize is how much of the end of a run's output is sent along
+// with a notification.
+const outputExcerptSize = 1024
+
+type NotifyHook struct {
+	URL     string   `json:"url,omitempty"`
+	Command string   `json:"command,omitempty"`
+	Events  []string `json:"events,omitempty"`
+}
+
+func (h NotifyHook) wants(event string) bool {
+	if event == eventTest || len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+type Notification struct {
+	Event     string        `json:"event"`
+	Timestamp string        `json:"timestamp"`
+	Entry     CronEntry     `json:"entry"`
+	History   *HistoryEntry `json:"history,omitempty"`
+	Output    string        `json:"output,omitempty"`
+	Missed    int           `json:"missed,omitempty"`
+}
+
+type DeliveryResult struct {
+	Hook   NotifyHook `json:"hook"`
+	Status string     `json:"status"`
+	Error  string     `json:"error,omitempty"`
+}
+
+type Notifier struct {
+	global   []NotifyHook
+	client   *http.Client
+	attempts int
+	backoff  time.Duration
+}
+
+func NewNotifier(global []NotifyHook) *Notifier {
+	return &Notifier{
+		global:   global,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		attempts: 3,
+		backoff:  2 * time.Second,
+	}
+}
+
+// Notify delivers the notification in the background to the entry's hooks
+// and the global hooks subscribed to its event.
+func (n *Notifier) Notify(entry CronEntry, notification Notification) {
+	notification.Entry = redactEntry(notification.Entry)
+	hooks := n.hooksFor(entry, notification.Event)
+	if len(hooks) == 0 {
+		return
+	}
+	go func() {
+		for _, hook := range hooks {
+			if err := n.deliver(hook, notification); err != nil {
+				fmt.Fprintf(defaultStderr, "cron %s: failed to deliver %s notification: %v\n", entry.Name, notification.Event, err)
+			}
+		}
+	}()
+}
+
+// NotifyNow delivers the notification synchronously and reports the outcome
+// of every hook.
+func (n *Notifier) NotifyNow(entry CronEntry, notification Notification) []DeliveryResult {
+	notification.Entry = redactEntry(notification.Entry)
+	results := []DeliveryResult{}
+	for _, hook := range n.hooksFor(entry, notification.Event) {
+		result := DeliveryResult{Hook: hook, Status: "DELIVERED"}
+		if err := n.deliver(hook, notification); err != nil {
+			result.Status = "FAILED"
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func (n *Notifier) hooksFor(entry CronEntry, event string) []NotifyHook {
+	var hooks []NotifyHook
+	for _, hook := range entry.Notify {
+		if hook.wants(event) {
+			hooks = append(hooks, hook)
+		}
+	}
+	for _, hook := range n.global {
+		if hook.wants(event) {
+			hooks = append(hooks, hook)
+		}
+	}
+	return hooks
+}
+
+func (n *Notifier) deliver(hook NotifyHook, notification Notification) error {
+	var err error
+	for attempt := 1; attempt <= n.attempts; attempt++ {
+		if hook.URL != "" {
+			err = n.post(hook.URL, notification)
+		} else {
+			err = runHookCommand(hook.Command, notification)
+		}
+		if err == nil {
+			return nil
+		}
+		if attempt < n.attempts {
+			time.Sleep(n.backoff * time.Duration(attempt))
+		}
+	}
+	return err
+}
+
+func (n *Notifier) post(url string, notification Notification) error {
+	data, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+func runHookCommand(command string, notification Notification) error {
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	cmd := shellCommand(command)
+	cmd.Env = append(os.Environ(),
+		"CRON_EVENT="+notification.Event,
+		"CRON_NAME="+notification.Entry.Name,
+		"CRON_TIMESTAMP="+notification.Timestamp,
+		"CRON_OUTPUT="+notification.Output,
+		"CRON_MISSED="+strconv.Itoa(notification.Missed),
+		"CRON_PAYLOAD="+string(payload),
+	)
+	if notification.History != nil {
+		cmd.Env = append(cmd.Env,
+			"CRON_STATUS="+notification.History.Status,
+			"CRON_JOB_ID="+notification.History.JobID,
+		)
+	}
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(excerpt(string(output))))
+	}
+	return nil
+}
+
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+	return exec.Command("sh", "-c", command)
+}
+
+// parseNotifyHook turns a --notify value into a hook: http(s) URLs are
+// webhooks, anything else is a local command.
+func parseNotifyHook(target, events string) (NotifyHook, error) {
+	hook := NotifyHook{}
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		hook.URL = target
+	} else {
+		hook.Command = target
+	}
+
+	for _, event := range strings.Split(events, ",") {
+		event = strings.TrimSpace(event)
+		if event == "" {
+			continue
+		}
+		if err := validateNotifyEvent(event); err != nil {
+			return hook, err
+		}
+		hook.Events = append(hook.Events, event)
+	}
+	return hook, nil
+}
+
+func validateNotifyEvent(event string) error {
+	for _, e := range notifyEvents {
+		if e == event {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid notify event: %s (expected %s)", event, strings.Join(notifyEvents, ", "))
+}
+
+func excerpt(output string) string {
+	if len(output) > outputExcerptSize {
+		return output[len(output)-outputExcerptSize:]
+	}
+	return output
+}
@@ -0,0 +1,537 @@
+package main
+
+// openAPIDocument describes the versioned API, served at
+// /api/v1/openapi.json.
+const openAPIDocument = `{
+  "openapi": "3.1.0",
+  "info": {
+    "title": "aux4 cron",
+    "version": "1",
+    "description": "Manage the entries and runs of an aux4 cron scheduler."
+  },
+  "servers": [{"url": "/api/v1"}],
+  "security": [{"bearer": []}, {}],
+  "paths": {
+    "/entries": {
+      "get": {
+        "operationId": "listEntries",
+        "summary": "List entries",
+        "responses": {
+          "200": {
+            "description": "The entries, with their last status",
+            "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/EntryView"}}}}
+          },
+          "401": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "operationId": "createEntry",
+        "summary": "Create an entry",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Entry"}}}
+        },
+        "responses": {
+          "201": {
+            "description": "The entry created",
+            "headers": {"Location": {"schema": {"type": "string"}}},
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Entry"}}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/entries/{name}": {
+      "parameters": [{"$ref": "#/components/parameters/name"}],
+      "get": {
+        "operationId": "getEntry",
+        "summary": "Get an entry",
+        "responses": {
+          "200": {
+            "description": "The entry, with its last status",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/EntryView"}}}
+          },
+          "401": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "patch": {
+        "operationId": "updateEntry",
+        "summary": "Update an entry with a JSON merge patch",
+        "description": "Members set to null are removed. Masked secrets keep their stored value. The name cannot be changed.",
+        "requestBody": {
+          "required": true,
+          "content": {"application/merge-patch+json": {"schema": {"type": "object"}}}
+        },
+        "responses": {
+          "200": {
+            "description": "The updated entry",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Entry"}}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "operationId": "deleteEntry",
+        "summary": "Remove an entry",
+        "responses": {
+          "204": {"description": "The entry was removed"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/entries/{name}:pause": {
+      "parameters": [{"$ref": "#/components/parameters/name"}],
+      "post": {
+        "operationId": "pauseEntry",
+        "summary": "Pause an entry",
+        "responses": {
+          "200": {
+            "description": "The paused entry",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Entry"}}}
+          },
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/entries/{name}:resume": {
+      "parameters": [{"$ref": "#/components/parameters/name"}],
+      "post": {
+        "operationId": "resumeEntry",
+        "summary": "Resume a paused entry",
+        "responses": {
+          "200": {
+            "description": "The resumed entry",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Entry"}}}
+          },
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/entries/{name}:run": {
+      "parameters": [{"$ref": "#/components/parameters/name"}],
+      "post": {
+        "operationId": "runEntry",
+        "summary": "Run an entry now, outside its schedule",
+        "responses": {
+          "202": {
+            "description": "The run is queued",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/QueuedRun"}}}
+          },
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/history": {
+      "get": {
+        "operationId": "listHistory",
+        "summary": "List past runs",
+        "parameters": [
+          {"name": "name", "in": "query", "schema": {"type": "string"}},
+          {"name": "status", "in": "query", "schema": {"type": "string"}},
+          {"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1, "default": 10}},
+          {"name": "since", "in": "query", "schema": {"type": "string"}, "description": "RFC3339 time or a duration ago, e.g. 12h"},
+          {"name": "until", "in": "query", "schema": {"type": "string"}},
+          {"name": "cursor", "in": "query", "schema": {"type": "integer"}, "description": "nextCursor of the previous page"},
+          {"name": "order", "in": "query", "schema": {"type": "string", "enum": ["asc", "desc"], "default": "asc"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "A page of history",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/HistoryPage"}}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/stats": {
+      "get": {
+        "operationId": "listStats",
+        "summary": "Run statistics per entry",
+        "parameters": [
+          {"name": "name", "in": "query", "schema": {"type": "string"}},
+          {"name": "window", "in": "query", "schema": {"type": "string"}, "description": "Only runs since this time or duration ago"}
+        ],
+        "responses": {
+          "200": {
+            "description": "The statistics",
+            "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/EntryStats"}}}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/running": {
+      "get": {
+        "operationId": "listRunning",
+        "summary": "List runs in progress",
+        "responses": {
+          "200": {
+            "description": "The runs in progress, oldest first",
+            "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Run"}}}}
+          },
+          "401": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/kill": {
+      "post": {
+        "operationId": "killRun",
+        "summary": "Cancel a run in progress",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {
+            "type": "object",
+            "required": ["run"],
+            "properties": {"run": {"type": "string", "description": "Run id"}},
+            "additionalProperties": false
+          }}}
+        },
+        "responses": {
+          "200": {
+            "description": "The run is being cancelled",
+            "content": {"application/json": {"schema": {
+              "type": "object",
+              "properties": {
+                "id": {"type": "string"},
+                "name": {"type": "string"},
+                "status": {"type": "string", "enum": ["CANCELLING"]}
+              }
+            }}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/apply": {
+      "post": {
+        "operationId": "applyEntries",
+        "summary": "Bring the entries in line with a manifest",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ApplyRequest"}}}
+        },
+        "responses": {
+          "200": {
+            "description": "The changes planned, and whether they were made",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ApplyResult"}}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/audit": {
+      "get": {
+        "operationId": "listAudit",
+        "summary": "List recorded changes, newest first by default",
+        "parameters": [
+          {"name": "name", "in": "query", "schema": {"type": "string"}},
+          {"name": "action", "in": "query", "schema": {"type": "string"}},
+          {"name": "caller", "in": "query", "schema": {"type": "string"}},
+          {"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1, "default": 50}},
+          {"name": "since", "in": "query", "schema": {"type": "string"}},
+          {"name": "until", "in": "query", "schema": {"type": "string"}},
+          {"name": "order", "in": "query", "schema": {"type": "string", "enum": ["asc", "desc"], "default": "desc"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "The audit records",
+            "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/AuditEntry"}}}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/export": {
+      "get": {
+        "operationId": "exportEntries",
+        "summary": "Render the entries as a manifest, crontab or systemd units",
+        "parameters": [
+          {"name": "format", "in": "query", "schema": {"type": "string", "enum": ["json", "yaml", "crontab", "systemd"], "default": "json"}},
+          {"name": "reveal", "in": "query", "schema": {"type": "boolean", "default": false}, "description": "Export secrets instead of masking them; needs an admin token"}
+        ],
+        "responses": {
+          "200": {
+            "description": "The rendered entries",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Export"}}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/graph": {
+      "get": {
+        "operationId": "getGraph",
+        "summary": "The dependencies between entries",
+        "responses": {
+          "200": {
+            "description": "The entries and the edges between them",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Graph"}}}
+          },
+          "401": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/openapi.json": {
+      "get": {
+        "operationId": "getOpenAPI",
+        "summary": "This document",
+        "security": [],
+        "responses": {
+          "200": {"description": "The OpenAPI document", "content": {"application/json": {}}}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "bearer": {"type": "http", "scheme": "bearer", "description": "A token created with aux4 cron token create"}
+    },
+    "parameters": {
+      "name": {"name": "name", "in": "path", "required": true, "schema": {"type": "string"}}
+    },
+    "responses": {
+      "HistoryEntry": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer"},
+          "name": {"type": "string"},
+          "runId": {"type": "string"},
+          "upstreamRunId": {"type": "string"},
+          "jobId": {"type": "string"},
+          "timestamp": {"type": "string", "format": "date-time"},
+          "status": {"type": "string", "enum": ["TRIGGERED", "SUCCESS", "FAILED", "TIMEOUT", "CANCELLED"]},
+          "attempt": {"type": "integer"},
+          "durationMs": {"type": "integer"},
+          "exitCode": {"type": "integer"},
+          "files": {"type": "array", "items": {"type": "string"}},
+          "caller": {"type": "string"},
+          "sourceIp": {"type": "string"}
+        }
+      },
+      "HistoryPage": {
+        "type": "object",
+        "required": ["history"],
+        "properties": {
+          "history": {"type": "array", "items": {"$ref": "#/components/schemas/HistoryEntry"}},
+          "nextCursor": {"type": "integer", "description": "Cursor of the next page, absent on the last one"}
+        }
+      },
+      "EntryStats": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "runs": {"type": "integer"},
+          "successes": {"type": "integer"},
+          "failures": {"type": "integer"},
+          "cancelled": {"type": "integer"},
+          "pending": {"type": "integer", "description": "Runs still TRIGGERED, left out of successRate"},
+          "successRate": {"type": "number"},
+          "avgDurationMs": {"type": "integer"},
+          "p95DurationMs": {"type": "integer"},
+          "lastSuccess": {"type": "string"},
+          "lastFailure": {"type": "string"},
+          "lastStatus": {"type": "string"},
+          "consecutiveFailures": {"type": "integer"}
+        }
+      },
+      "Run": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "name": {"type": "string"},
+          "pid": {"type": "integer"},
+          "startedAt": {"type": "string", "format": "date-time"},
+          "source": {"type": "string", "enum": ["schedule", "catch-up", "manual", "chain", "watch", "hook"]},
+          "attempt": {"type": "integer"}
+        }
+      },
+      "ApplyRequest": {
+        "type": "object",
+        "required": ["entries"],
+        "properties": {
+          "entries": {"type": "array", "items": {"$ref": "#/components/schemas/Entry"}},
+          "prune": {"type": "boolean", "default": false, "description": "Remove the entries missing from the manifest"},
+          "dryRun": {"type": "boolean", "default": false, "description": "Only return the plan"}
+        },
+        "additionalProperties": false
+      },
+      "ApplyResult": {
+        "type": "object",
+        "properties": {
+          "plan": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "properties": {
+                "action": {"type": "string"},
+                "name": {"type": "string"},
+                "fields": {"type": "array", "items": {"type": "string"}},
+                "before": {"$ref": "#/components/schemas/Entry"},
+                "after": {"$ref": "#/components/schemas/Entry"}
+              }
+            }
+          },
+          "applied": {"type": "boolean"}
+        }
+      },
+      "AuditEntry": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer"},
+          "timestamp": {"type": "string", "format": "date-time"},
+          "action": {"type": "string"},
+          "name": {"type": "string"},
+          "runId": {"type": "string"},
+          "caller": {"type": "string"},
+          "remoteAddr": {"type": "string"},
+          "source": {"type": "string"},
+          "before": {"$ref": "#/components/schemas/Entry"},
+          "after": {"$ref": "#/components/schemas/Entry"}
+        }
+      },
+      "Export": {
+        "type": "object",
+        "properties": {
+          "format": {"type": "string"},
+          "content": {"type": "string", "description": "The rendered file"},
+          "warnings": {"type": "array", "items": {"type": "string"}, "description": "What the format could not represent"}
+        }
+      },
+      "Graph": {
+        "type": "object",
+        "properties": {
+          "nodes": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "properties": {
+                "name": {"type": "string"},
+                "schedule": {"type": "string"},
+                "state": {"type": "string", "enum": ["active", "paused"]}
+              }
+            }
+          },
+          "edges": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "properties": {
+                "from": {"type": "string"},
+                "to": {"type": "string"},
+                "condition": {"type": "string", "enum": ["success", "failure", "always"]}
+              }
+            }
+          }
+        }
+      },
+      "Error": {
+        "description": "The request failed",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}
+      }
+    },
+    "schemas": {
+      "QueuedRun": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "runId": {"type": "string"},
+          "status": {"type": "string", "enum": ["QUEUED"]}
+        }
+      },
+      "Entry": {
+        "type": "object",
+        "required": ["name"],
+        "properties": {
+          "name": {"type": "string"},
+          "every": {"type": "string", "description": "Interval between runs, e.g. 5m"},
+          "at": {"type": "string", "description": "Time of day or cron expression"},
+          "in": {"type": "string", "description": "Run once after this delay"},
+          "max": {"type": "integer", "minimum": 1},
+          "retries": {"type": "integer", "minimum": 0},
+          "timeout": {"type": "string"},
+          "run": {"type": "string", "description": "aux4 command to run"},
+          "args": {"type": "array", "items": {"type": "string"}},
+          "env": {"type": "object", "additionalProperties": {"type": "string"}},
+          "envFile": {"type": "string"},
+          "workdir": {"type": "string"},
+          "user": {"type": "string"},
+          "group": {"type": "string"},
+          "watch": {"type": "string", "description": "Glob of files whose changes trigger the entry"},
+          "debounce": {"type": "string"},
+          "minInterval": {"type": "string"},
+          "onSuccess": {"type": "array", "items": {"type": "string"}},
+          "onFailure": {"type": "array", "items": {"type": "string"}},
+          "after": {"type": "array", "items": {"type": "string"}},
+          "delay": {"type": "string"},
+          "hook": {
+            "type": "object",
+            "required": ["secret"],
+            "properties": {
+              "secret": {"type": "string"},
+              "rate": {"type": "integer", "minimum": 0}
+            }
+          },
+          "notify": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "properties": {
+                "url": {"type": "string"},
+                "command": {"type": "string"},
+                "events": {"type": "array", "items": {"type": "string"}}
+              }
+            }
+          },
+          "state": {"type": "string", "enum": ["active", "paused"], "default": "active"}
+        }
+      },
+      "EntryView": {
+        "allOf": [
+          {"$ref": "#/components/schemas/Entry"},
+          {
+            "type": "object",
+            "properties": {
+              "lastStatus": {"type": "string"},
+              "consecutiveFailures": {"type": "integer"}
+            }
+          }
+        ]
+      },
+      "Error": {
+        "type": "object",
+        "required": ["error"],
+        "properties": {"error": {"type": "string"}}
+      }
+    }
+  }
+}
+`
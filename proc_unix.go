@@ -0,0 +1,107 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// setProcessGroup starts the command in its own process group so that the
+// command and everything it spawned can be signalled together.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// runAs makes the command run as the given user and/or group and returns
+// the HOME, USER and LOGNAME variables of the user. It is only supported on
+// Linux with the scheduler running as root.
+func runAs(cmd *exec.Cmd, username, group string) ([]string, error) {
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("running as another user is only supported on linux")
+	}
+	if os.Geteuid() != 0 {
+		return nil, fmt.Errorf("running as another user requires the scheduler to run as root")
+	}
+
+	credential := &syscall.Credential{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	var env []string
+	if username != "" {
+		u, err := user.Lookup(username)
+		if err != nil {
+			if u, err = user.LookupId(username); err != nil {
+				return nil, fmt.Errorf("unknown user: %s", username)
+			}
+		}
+		uid, _ := strconv.ParseUint(u.Uid, 10, 32)
+		gid, _ := strconv.ParseUint(u.Gid, 10, 32)
+		credential.Uid = uint32(uid)
+		credential.Gid = uint32(gid)
+		if ids, err := u.GroupIds(); err == nil {
+			for _, id := range ids {
+				if n, err := strconv.ParseUint(id, 10, 32); err == nil {
+					credential.Groups = append(credential.Groups, uint32(n))
+				}
+			}
+		}
+		env = append(env, "HOME="+u.HomeDir, "USER="+u.Username, "LOGNAME="+u.Username)
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			if g, err = user.LookupGroupId(group); err != nil {
+				return nil, fmt.Errorf("unknown group: %s", group)
+			}
+		}
+		gid, _ := strconv.ParseUint(g.Gid, 10, 32)
+		credential.Gid = uint32(gid)
+	}
+
+	cmd.SysProcAttr.Credential = credential
+	return env, nil
+}
+
+func terminateProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// processAlive reports whether the process exists and has not exited. An
+// exited process not yet reaped by its parent (a zombie) counts as gone.
+func processAlive(process *os.Process) bool {
+	if process.Signal(syscall.Signal(0)) != nil {
+		return false
+	}
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(process.Pid) + "/stat")
+	if err != nil {
+		return true
+	}
+	// The state follows the parenthesized command name
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) == 0 || fields[0] != "Z"
+}
+
+// checkPrivateDir checks that only the current user can use the directory,
+// so that nobody else can plant a pid file or socket in it.
+func checkPrivateDir(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("%s is owned by another user", path)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%s is accessible by other users (mode %o)", path, info.Mode().Perm())
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+func runAs(cmd *exec.Cmd, username, group string) ([]string, error) {
+	return nil, fmt.Errorf("running as another user is only supported on linux")
+}
+
+// Windows has no SIGTERM; the process is killed right away.
+func terminateProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+func processAlive(process *os.Process) bool {
+	return process.Signal(syscall.Signal(0)) == nil
+}
+
+// Windows directories are protected by ACLs rather than modes.
+func checkPrivateDir(path string) error {
+	_, err := os.Stat(path)
+	return err
+}
@@ -1,9 +1,7 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
@@ -19,6 +17,7 @@ const (
 	scheduleWeekly
 	scheduleMonthly
 	scheduleOnce
+	scheduleWatch
 )
 
 type schedule struct {
@@ -29,23 +28,59 @@ type schedule struct {
 	AtMinute int
 }
 
+// missedThreshold is how late a calendar run may fire before it is reported
+// as missed.
+const missedThreshold = time.Minute
+
 type Scheduler struct {
-	mu      sync.Mutex
-	store   *CronStore
-	timers  map[string]chan struct{}
-	running bool
+	mu    sync.Mutex
+	store *CronStore
+	// defaultTimeout applies to entries without their own timeout; zero
+	// means no limit
+	defaultTimeout time.Duration
+	metrics        *Metrics
+	notifier       *Notifier
+	// tracker follows jobs until they finish; nil leaves runs TRIGGERED
+	tracker *JobTracker
+	audit   *AuditLog
+	events  *EventBus
+	// concurrency is the number of workers executing runs
+	concurrency int
+	queue       chan runRequest
+	inFlight    map[string]time.Time
+	runs        map[string]*Run
+	workerStop  chan struct{}
+	timers      map[string]chan struct{}
+	nextFire    map[string]time.Time
+	running     bool
+	lastTick    time.Time
+	tickStop    chan struct{}
 }
 
 func NewScheduler(store *CronStore) *Scheduler {
 	return &Scheduler{
-		store:  store,
-		timers: make(map[string]chan struct{}),
+		store:       store,
+		metrics:     NewMetrics(),
+		notifier:    NewNotifier(nil),
+		concurrency: defaultConcurrency,
+		queue:       make(chan runRequest, runQueueSize),
+		inFlight:    make(map[string]time.Time),
+		runs:        make(map[string]*Run),
+		timers:      make(map[string]chan struct{}),
+		nextFire:    make(map[string]time.Time),
 	}
 }
 
 func (s *Scheduler) Start() {
 	s.mu.Lock()
 	s.running = true
+	s.lastTick = time.Now()
+	s.tickStop = make(chan struct{})
+	go s.heartbeat(s.tickStop)
+	s.workerStop = make(chan struct{})
+	for i := 0; i < s.concurrency; i++ {
+		go s.worker(s.workerStop)
+	}
 	s.mu.Unlock()
 
 	entries := s.store.List()
@@ -56,14 +91,21 @@ func (s *Scheduler) Start() {
 	}
 }
 
+// Stop stops firing entries. Runs already queued or in progress are left to
+// the workers; see Drain.
 func (s *Scheduler) Stop() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	s.running = false
+	if s.tickStop != nil {
+		close(s.tickStop)
+		s.tickStop = nil
+	}
 	for name, stop := range s.timers {
 		close(stop)
 		delete(s.timers, name)
+		delete(s.nextFire, name)
 	}
 }
 
@@ -88,19 +130,97 @@ func (s *Scheduler) Unschedule(name string) {
 		close(stop)
 		delete(s.timers, name)
 	}
+	delete(s.nextFire, name)
 }
 
-func (s *Scheduler) scheduleEntry(entry CronEntry) {
-	var sched *schedule
-	var err error
+// Reschedule replaces the schedule of an entry after it changed. Paused
+// entries are left unscheduled.
+func (s *Scheduler) Reschedule(entry CronEntry) {
+	s.Unschedule(entry.Name)
+	s.Schedule(entry)
+}
+
+// heartbeat records a tick every second so health checks can tell the
+// scheduler goroutines are still being run.
+func (s *Scheduler) heartbeat(stop chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case t := <-ticker.C:
+			s.mu.Lock()
+			s.lastTick = t
+			s.mu.Unlock()
+		}
+	}
+}
+
+// LastTick returns the time of the latest heartbeat.
+func (s *Scheduler) LastTick() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastTick
+}
+
+// HasTimer reports whether a schedule goroutine is live for the entry.
+func (s *Scheduler) HasTimer(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.timers[name]
+	return ok
+}
+
+// NextFires returns the next planned fire time of every scheduled entry.
+func (s *Scheduler) NextFires() map[string]time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make(map[string]time.Time, len(s.nextFire))
+	for name, t := range s.nextFire {
+		result[name] = t
+	}
+	return result
+}
+
+func (s *Scheduler) setNextFire(name string, next time.Time, stop chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Only the goroutine owning the current timer may update it
+	if s.timers[name] == stop {
+		s.nextFire[name] = next
+	}
+}
 
+// entrySchedule parses the schedule of an entry: --in and a standalone --at
+// run once, anything else repeats.
+func entrySchedule(entry CronEntry) (*schedule, error) {
+	if entry.Watch != "" {
+		return &schedule{Type: scheduleWatch}, nil
+	}
 	if entry.In != "" {
-		sched, err = parseIn(entry.In)
-	} else if entry.Every == "" && entry.At != "" {
-		sched, err = parseAt(entry.At)
-	} else {
-		sched, err = parseSchedule(entry.Every, entry.At)
+		return parseIn(entry.In)
+	}
+	if entry.Every == "" && entry.At != "" {
+		return parseAt(entry.At)
+	}
+	return parseSchedule(entry.Every, entry.At)
+}
+
+// hasSchedule reports whether the entry runs on its own, rather than only
+// after other entries.
+func hasSchedule(entry CronEntry) bool {
+	return entry.Every != "" || entry.In != "" || entry.At != "" || entry.Watch != ""
+}
+
+func (s *Scheduler) scheduleEntry(entry CronEntry) {
+	if !hasSchedule(entry) {
+		return
 	}
+	sched, err := entrySchedule(entry)
 	if err != nil {
 		fmt.Fprintf(defaultStderr, "failed to parse schedule for %s: %v\n", entry.Name, err)
 		return
@@ -121,33 +241,56 @@ func (s *Scheduler) scheduleEntry(entry CronEntry) {
 	s.timers[entry.Name] = stop
 	s.mu.Unlock()
 
-	go s.runSchedule(entry.Name, entry.Run, sched, max, stop)
+	go s.runSchedule(entry, sched, max, stop)
 }
 
-func (s *Scheduler) runSchedule(name, command string, sched *schedule, max int, stop chan struct{}) {
+func (s *Scheduler) runSchedule(entry CronEntry, sched *schedule, max int, stop chan struct{}) {
+	defer s.release(entry.Name, stop)
+
 	switch sched.Type {
 	case scheduleOnce:
-		s.runOnce(name, command, sched.Interval, stop)
+		s.runOnce(entry, sched.Interval, stop)
 	case scheduleInterval:
-		s.runInterval(name, command, sched.Interval, max, stop)
+		s.runInterval(entry, sched.Interval, max, stop)
 	case scheduleDaily, scheduleWeekly, scheduleMonthly:
-		s.runCalendar(name, command, sched, max, stop)
+		s.runCalendar(entry, sched, max, stop)
+	case scheduleWatch:
+		s.runWatch(entry, max, stop)
+	}
+}
+
+// release drops the timer of a schedule goroutine that returned on its own,
+// so that timers only ever holds live goroutines.
+func (s *Scheduler) release(name string, stop chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.timers[name] == stop {
+		delete(s.timers, name)
+		delete(s.nextFire, name)
 	}
 }
 
-func (s *Scheduler) runOnce(name, command string, delay time.Duration, stop chan struct{}) {
+func (s *Scheduler) runOnce(entry CronEntry, delay time.Duration, stop chan struct{}) {
+	planned := time.Now().Add(delay)
+	s.setNextFire(entry.Name, planned, stop)
+
 	timer := time.NewTimer(delay)
 	select {
 	case <-stop:
 		timer.Stop()
 		return
 	case <-timer.C:
-		s.trigger(name, command)
-		s.autoRemove(name)
+		// The task is removed once its run finished, or left in place when
+		// the fire is refused
+		s.enqueue(runRequest{entry: entry, planned: planned, source: sourceSchedule, last: true})
 	}
 }
 
-func (s *Scheduler) runInterval(name, command string, interval time.Duration, max int, stop chan struct{}) {
+func (s *Scheduler) runInterval(entry CronEntry, interval time.Duration, max int, stop chan struct{}) {
+	start := time.Now()
+	s.setNextFire(entry.Name, start.Add(interval), stop)
+
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
@@ -157,20 +300,28 @@ func (s *Scheduler) runInterval(name, command string, interval time.Duration, ma
 		case <-stop:
 			return
 		case <-ticker.C:
-			s.trigger(name, command)
+			// The planned time is the latest multiple of the interval, so
+			// late ticks do not shift the schedule
+			elapsed := time.Since(start)
+			planned := start.Add(elapsed - elapsed%interval)
+			s.setNextFire(entry.Name, planned.Add(interval), stop)
+			last := max > 0 && count+1 >= max
+			if !s.enqueue(runRequest{entry: entry, planned: planned, source: sourceSchedule, last: last}) {
+				continue
+			}
 			count++
-			if max > 0 && count >= max {
-				s.autoRemove(name)
+			if last {
 				return
 			}
 		}
 	}
 }
 
-func (s *Scheduler) runCalendar(name, command string, sched *schedule, max int, stop chan struct{}) {
+func (s *Scheduler) runCalendar(entry CronEntry, sched *schedule, max int, stop chan struct{}) {
 	count := 0
 	for {
 		next := nextOccurrence(sched)
+		s.setNextFire(entry.Name, next, stop)
 		waitDuration := time.Until(next)
 		if waitDuration < 0 {
 			waitDuration = 0
@@ -182,54 +333,38 @@ func (s *Scheduler) runCalendar(name, command string, sched *schedule, max int,
 			timer.Stop()
 			return
 		case <-timer.C:
-			s.trigger(name, command)
+			source := sourceSchedule
+			if time.Since(next) > missedThreshold {
+				s.missed(entry, 1, "fired late")
+				source = sourceCatchUp
+			}
+			last := max > 0 && count+1 >= max
+			if !s.enqueue(runRequest{entry: entry, planned: next, source: source, last: last}) {
+				continue
+			}
 			count++
-			if max > 0 && count >= max {
-				s.autoRemove(name)
+			if last {
 				return
 			}
 		}
 	}
 }
 
+// autoRemove removes an entry whose last run finished. The entries that
+// depend on it lose their references to it rather than keeping it alive.
 func (s *Scheduler) autoRemove(name string) {
 	s.Unschedule(name)
-	if err := s.store.Remove(name); err != nil {
-		fmt.Fprintf(defaultStderr, "cron %s: failed to auto-remove: %v\n", name, err)
-	} else {
-		fmt.Fprintf(defaultStderr, "cron %s: completed and removed\n", name)
-	}
-}
-
-func (s *Scheduler) trigger(name, command string) {
-	now := time.Now().UTC().Format(time.RFC3339)
-
-	jobID := ""
-	status := "TRIGGERED"
-
-	cmd := exec.Command("aux4", "jobs", "run", command)
-	output, err := cmd.Output()
+	before, _ := s.store.Get(name)
+	detached, err := s.store.Retire(name)
 	if err != nil {
-		status = "FAILED"
-		fmt.Fprintf(defaultStderr, "cron %s: failed to run job: %v\n", name, err)
-	} else {
-		var result map[string]interface{}
-		if jsonErr := json.Unmarshal(output, &result); jsonErr == nil {
-			if id, ok := result["id"]; ok {
-				jobID = fmt.Sprintf("%v", id)
-			}
-		}
-	}
-
-	entry := HistoryEntry{
-		Name:      name,
-		JobID:     jobID,
-		Timestamp: now,
-		Status:    status,
+		fmt.Fprintf(defaultStderr, "cron %s: failed to auto-remove: %v\n", name, err)
+		return
 	}
-
-	if histErr := s.store.AddHistory(entry); histErr != nil {
-		fmt.Fprintf(defaultStderr, "cron %s: failed to save history: %v\n", name, histErr)
+	fmt.Fprintf(defaultStderr, "cron %s: completed and removed\n", name)
+	s.audit.Record(AuditEntry{Action: actionRemove, Name: name, Caller: "scheduler", Source: "max", Before: before})
+	for i := range detached {
+		after, _ := s.store.Get(detached[i].Name)
+		s.audit.Record(AuditEntry{Action: actionUpdate, Name: detached[i].Name, Caller: "scheduler", Source: "max", Before: &detached[i], After: after})
 	}
 }
 
@@ -325,6 +460,9 @@ func parseSchedule(every, at string) (*schedule, error) {
 	if matches := intervalRegex.FindStringSubmatch(every); matches != nil {
 		n, _ := strconv.Atoi(matches[1])
 		unit := matches[2]
+		if n < 1 {
+			return nil, fmt.Errorf("invalid schedule expression: %s (interval must be greater than zero)", every)
+		}
 
 		switch unit {
 		case "s", "sec", "secs", "second", "seconds":
@@ -356,8 +494,16 @@ func parseAt(at string) (*schedule, error) {
 }
 
 func parseIn(in string) (*schedule, error) {
-	in = strings.TrimSpace(strings.ToLower(in))
-	if matches := intervalRegex.FindStringSubmatch(in); matches != nil {
+	d, err := parseInterval(in)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --in expression: %s", strings.TrimSpace(strings.ToLower(in)))
+	}
+	return &schedule{Type: scheduleOnce, Interval: d}, nil
+}
+
+func parseInterval(expr string) (time.Duration, error) {
+	expr = strings.TrimSpace(strings.ToLower(expr))
+	if matches := intervalRegex.FindStringSubmatch(expr); matches != nil {
 		n, _ := strconv.Atoi(matches[1])
 		unit := matches[2]
 		var d time.Duration
@@ -371,9 +517,26 @@ func parseIn(in string) (*schedule, error) {
 		case "d", "day", "days":
 			d = time.Duration(n) * 24 * time.Hour
 		}
-		return &schedule{Type: scheduleOnce, Interval: d}, nil
+		return d, nil
+	}
+	return 0, fmt.Errorf("invalid interval: %s", expr)
+}
+
+// parseTimeBound parses a history range bound: an RFC3339 timestamp, a
+// YYYY-MM-DD date in local time, or an interval (e.g. 12h, 1 day) meaning
+// that long ago.
+func parseTimeBound(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	if d, err := parseInterval(value); err == nil {
+		return time.Now().Add(-d), nil
 	}
-	return nil, fmt.Errorf("invalid --in expression: %s", in)
+	return time.Time{}, fmt.Errorf("invalid time: %s (expected RFC3339, YYYY-MM-DD or an interval like 12h)", value)
 }
 
 var timeRegex = regexp.MustCompile(`(?i)^(\d{1,2})(?::(\d{2}))?\s*(am|pm)?$`)
@@ -1,16 +1,22 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 var defaultStderr io.Writer = os.Stderr
@@ -18,6 +24,23 @@ var defaultStderr io.Writer = os.Stderr
 func startServer(args []string) {
 	port := getArg(args, 0, "8421")
 	dir := getArg(args, 1, ".")
+	timeout := getArg(args, 2, "")
+	concurrency := getArg(args, 3, "")
+	drainTimeout := getArg(args, 4, "30s")
+	watch := getArg(args, 5, "")
+	trackJobs := getArg(args, 6, "true")
+	bind := getArg(args, 7, "127.0.0.1")
+	socket := getArg(args, 8, "")
+	socketMode := getArg(args, 9, "0600")
+	tlsCert := getArg(args, 10, "")
+	tlsKey := getArg(args, 11, "")
+	tlsClientCA := getArg(args, 12, "")
+	tlsClientRoles := getArg(args, 13, "")
+
+	if err := ensureRuntimeDir(); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid runtime directory: %v\n", err)
+		os.Exit(1)
+	}
 
 	// If already running, exit successfully
 	pidFile := pidFilePath(port)
@@ -50,9 +73,97 @@ func startServer(args []string) {
 		os.Exit(1)
 	}
 
+	hooks, err := store.LoadNotifyHooks()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load notification hooks: %v\n", err)
+		os.Exit(1)
+	}
+
+	events := NewEventBus()
+	audit := NewAuditLog(absDir)
+	audit.events = events
 	scheduler := NewScheduler(store)
+	scheduler.audit = audit
+	scheduler.events = events
+	scheduler.notifier = NewNotifier(hooks)
+	if trackJobs == "true" {
+		scheduler.tracker = NewJobTracker()
+	}
+	if timeout != "" {
+		d, err := parseInterval(timeout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid timeout: %v\n", err)
+			os.Exit(1)
+		}
+		scheduler.defaultTimeout = d
+	}
+	if concurrency != "" {
+		n, err := strconv.Atoi(concurrency)
+		if err != nil || n < 1 {
+			fmt.Fprintln(os.Stderr, "concurrency must be a positive integer")
+			os.Exit(1)
+		}
+		scheduler.concurrency = n
+	}
+	drainWait, err := parseInterval(drainTimeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid drain timeout: %v\n", err)
+		os.Exit(1)
+	}
+	var watchEvery time.Duration
+	if watch != "" {
+		watchEvery, err = parseInterval(watch)
+		if err != nil || watchEvery <= 0 {
+			fmt.Fprintf(os.Stderr, "invalid watch interval: %s\n", watch)
+			os.Exit(1)
+		}
+	}
+	started := time.Now()
+
+	// reload applies a changed .cron.json to the running schedule; only the
+	// entries that changed are rescheduled
+	reload := func(reason string) {
+		previous := make(map[string]CronEntry)
+		for _, e := range store.List() {
+			previous[e.Name] = e
+		}
+		diff, err := store.Reload()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reload (%s) rejected, keeping current entries: %v\n", reason, err)
+			return
+		}
+		if !diff.Changed() && reason == "watch" {
+			return
+		}
+		changed := func(action, name string, after *CronEntry) {
+			var before *CronEntry
+			if e, ok := previous[name]; ok {
+				before = &e
+			}
+			audit.Record(AuditEntry{Action: action, Name: name, Caller: "reload", Source: reason, Before: before, After: after})
+		}
+		for _, name := range diff.Removed {
+			scheduler.Unschedule(name)
+			changed(actionRemove, name, nil)
+		}
+		for _, name := range diff.Added {
+			if entry, err := store.Get(name); err == nil {
+				scheduler.Reschedule(*entry)
+				changed(actionAdd, name, entry)
+			}
+		}
+		for _, name := range diff.Updated {
+			if entry, err := store.Get(name); err == nil {
+				scheduler.Reschedule(*entry)
+				changed(actionUpdate, name, entry)
+			}
+		}
+		fmt.Fprintf(os.Stderr, "reloaded .cron.json (%s): %s\n", reason, diff)
+	}
 
 	mux := http.NewServeMux()
+	service := &entryService{store: store, scheduler: scheduler, audit: audit}
+	registerAPI(mux, service)
 
 	mux.HandleFunc("/add", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
@@ -64,66 +175,113 @@ func startServer(args []string) {
 		at := r.URL.Query().Get("at")
 		in := r.URL.Query().Get("in")
 		maxStr := r.URL.Query().Get("max")
+		retriesStr := r.URL.Query().Get("retries")
+		timeout := r.URL.Query().Get("timeout")
 		run := r.URL.Query().Get("run")
+		notifyOn := r.URL.Query().Get("notifyOn")
 
-		if name == "" {
-			httpError(w, http.StatusBadRequest, "name is required")
-			return
+		var args []string
+		if argsStr := r.URL.Query().Get("args"); argsStr != "" {
+			if err := json.Unmarshal([]byte(argsStr), &args); err != nil {
+				httpError(w, http.StatusBadRequest, "args must be a JSON array of strings")
+				return
+			}
 		}
-		if every == "" && in == "" && at == "" {
-			httpError(w, http.StatusBadRequest, "every, in, or at is required")
+
+		env, err := parseEnvList(r.URL.Query().Get("env"))
+		if err != nil {
+			httpError(w, http.StatusBadRequest, err.Error())
 			return
 		}
-		if run == "" {
-			httpError(w, http.StatusBadRequest, "run is required")
-			return
+		if len(env) == 0 {
+			env = nil
 		}
 
-		// Validate schedule expression
-		if in != "" {
-			if _, err := parseIn(in); err != nil {
-				httpError(w, http.StatusBadRequest, err.Error())
+		max := 0
+		if maxStr != "" {
+			n, err := strconv.Atoi(maxStr)
+			if err != nil || n < 1 {
+				httpError(w, http.StatusBadRequest, "max must be a positive integer")
 				return
 			}
-		} else if every == "" && at != "" {
-			if _, err := parseAt(at); err != nil {
-				httpError(w, http.StatusBadRequest, err.Error())
+			max = n
+		}
+
+		retries := 0
+		if retriesStr != "" {
+			n, err := strconv.Atoi(retriesStr)
+			if err != nil || n < 0 {
+				httpError(w, http.StatusBadRequest, "retries must be a non-negative integer")
 				return
 			}
-		} else {
-			if _, err := parseSchedule(every, at); err != nil {
+			retries = n
+		}
+
+		if notifyOn != "" {
+			if _, err := parseNotifyHook("", notifyOn); err != nil {
 				httpError(w, http.StatusBadRequest, err.Error())
 				return
 			}
 		}
 
-		max := 0
-		if maxStr != "" {
-			n, err := strconv.Atoi(maxStr)
-			if err != nil || n < 1 {
-				httpError(w, http.StatusBadRequest, "max must be a positive integer")
+		var notify []NotifyHook
+		for _, target := range r.URL.Query()["notify"] {
+			if target == "" {
+				continue
+			}
+			hook, err := parseNotifyHook(target, notifyOn)
+			if err != nil {
+				httpError(w, http.StatusBadRequest, err.Error())
 				return
 			}
-			max = n
+			notify = append(notify, hook)
 		}
 
 		entry := CronEntry{
-			Name:  name,
-			Every: every,
-			At:    at,
-			In:    in,
-			Max:   max,
-			Run:   run,
-			State: "active",
+			Name:        name,
+			Every:       every,
+			At:          at,
+			In:          in,
+			Max:         max,
+			Retries:     retries,
+			Timeout:     timeout,
+			Run:         run,
+			Args:        args,
+			Env:         env,
+			EnvFile:     r.URL.Query().Get("envFile"),
+			Workdir:     r.URL.Query().Get("workdir"),
+			User:        r.URL.Query().Get("user"),
+			Group:       r.URL.Query().Get("group"),
+			Notify:      notify,
+			State:       "active",
+			OnSuccess:   splitList(r.URL.Query().Get("onSuccess")),
+			OnFailure:   splitList(r.URL.Query().Get("onFailure")),
+			After:       splitList(r.URL.Query().Get("after")),
+			Delay:       r.URL.Query().Get("delay"),
+			Watch:       r.URL.Query().Get("watch"),
+			Debounce:    r.URL.Query().Get("debounce"),
+			MinInterval: r.URL.Query().Get("minInterval"),
 		}
-
-		if err := store.Add(entry); err != nil {
-			httpError(w, http.StatusConflict, err.Error())
+		if secret := r.URL.Query().Get("hookSecret"); secret != "" {
+			entry.Hook = &EntryHook{Secret: secret}
+			if rate := r.URL.Query().Get("hookRate"); rate != "" {
+				n, err := strconv.Atoi(rate)
+				if err != nil {
+					httpError(w, http.StatusBadRequest, "hookRate must be an integer")
+					return
+				}
+				entry.Hook.Rate = n
+			}
+		} else if r.URL.Query().Get("hookRate") != "" {
+			httpError(w, http.StatusBadRequest, "hookRate requires hookSecret")
 			return
 		}
 
-		scheduler.Schedule(entry)
-		httpJSON(w, http.StatusCreated, entry)
+		if err := service.create(r, entry); err != nil {
+			httpError(w, errorStatus(err, http.StatusConflict), err.Error())
+			return
+		}
+		httpJSON(w, http.StatusCreated, redactEntry(entry))
 	})
 
 	mux.HandleFunc("/remove", func(w http.ResponseWriter, r *http.Request) {
@@ -137,10 +295,8 @@ func startServer(args []string) {
 			return
 		}
 
-		scheduler.Unschedule(name)
-
-		if err := store.Remove(name); err != nil {
-			httpError(w, http.StatusNotFound, err.Error())
+		if err := service.remove(r, name); err != nil {
+			httpError(w, errorStatus(err, http.StatusNotFound), err.Error())
 			return
 		}
 
@@ -158,11 +314,9 @@ func startServer(args []string) {
 			return
 		}
 
-		scheduler.Unschedule(name)
-
-		entry, err := store.SetState(name, "paused")
+		entry, err := service.pause(r, name)
 		if err != nil {
-			httpError(w, http.StatusNotFound, err.Error())
+			httpError(w, errorStatus(err, http.StatusNotFound), err.Error())
 			return
 		}
 
@@ -180,14 +334,12 @@ func startServer(args []string) {
 			return
 		}
 
-		entry, err := store.SetState(name, "active")
+		entry, err := service.resume(r, name)
 		if err != nil {
-			httpError(w, http.StatusNotFound, err.Error())
+			httpError(w, errorStatus(err, http.StatusNotFound), err.Error())
 			return
 		}
 
-		scheduler.Schedule(*entry)
-
 		httpJSON(w, http.StatusOK, map[string]string{"name": entry.Name, "state": entry.State})
 	})
 
@@ -196,8 +348,13 @@ func startServer(args []string) {
 			httpError(w, http.StatusMethodNotAllowed, "method not allowed")
 			return
 		}
+		summaries := store.Summaries()
 		entries := store.List()
-		httpJSON(w, http.StatusOK, entries)
+		views := make([]entryView, len(entries))
+		for i, e := range entries {
+			views[i] = entryView{CronEntry: redactEntry(e), EntrySummary: summaries[e.Name]}
+		}
+		httpJSON(w, http.StatusOK, views)
 	})
 
 	mux.HandleFunc("/history", func(w http.ResponseWriter, r *http.Request) {
@@ -205,20 +362,383 @@ func startServer(args []string) {
 			httpError(w, http.StatusMethodNotAllowed, "method not allowed")
 			return
 		}
+		query, err := historyQuery(r.URL.Query())
+		if err != nil {
+			httpError(w, errorStatus(err, http.StatusBadRequest), err.Error())
+			return
+		}
+
+		history, more := store.QueryHistory(query)
+		if more && len(history) > 0 {
+			w.Header().Set("X-Next-Cursor", strconv.FormatInt(history[len(history)-1].ID, 10))
+		}
+		httpJSON(w, http.StatusOK, history)
+	})
+
+	mux.HandleFunc("/apply", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		var desired []CronEntry
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&desired); err != nil {
+			httpError(w, http.StatusBadRequest, "invalid entries: "+err.Error())
+			return
+		}
+		prune := r.URL.Query().Get("prune") == "true"
+		dryRun := r.URL.Query().Get("dryRun") == "true"
+
+		result, err := service.apply(r, desired, prune, dryRun)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		httpJSON(w, http.StatusOK, result)
+	})
+
+	mux.HandleFunc("/audit", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		query, err := auditQuery(r.URL.Query())
+		if err != nil {
+			httpError(w, errorStatus(err, http.StatusBadRequest), err.Error())
+			return
+		}
+
+		entries, err := audit.Query(query)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		httpJSON(w, http.StatusOK, entries)
+	})
+
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		serveEvents(w, r, events)
+	})
+
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		stats, err := entryStats(store, r.URL.Query())
+		if err != nil {
+			httpError(w, errorStatus(err, http.StatusNotFound), err.Error())
+			return
+		}
+		httpJSON(w, http.StatusOK, stats)
+	})
+
+	mux.HandleFunc("/export", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "json"
+		}
+		entries, err := service.exported(r, r.URL.Query().Get("reveal"))
+		if err != nil {
+			httpError(w, errorStatus(err, http.StatusBadRequest), err.Error())
+			return
+		}
+		data, warnings, err := renderEntries(entries, format)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		for _, warning := range warnings {
+			w.Header().Add("X-Export-Warning", warning)
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(data)
+	})
+
+	mux.HandleFunc("/graph", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		entries := store.List()
+		switch format := r.URL.Query().Get("format"); format {
+		case "", "text":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			writeGraphText(w, entries)
+		case "dot":
+			w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+			writeGraphDOT(w, entries)
+		default:
+			httpError(w, http.StatusBadRequest, "invalid format: "+format+" (expected text or dot)")
+		}
+	})
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		scheduler.metrics.Write(w, store.List(), scheduler.NextFires())
+	})
+
+	mux.HandleFunc("/notify/test", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		entry := &CronEntry{Name: "test"}
+		if name := r.URL.Query().Get("name"); name != "" {
+			e, err := store.Get(name)
+			if err != nil {
+				httpError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			entry = e
+		}
+
+		results := scheduler.notifier.NotifyNow(*entry, Notification{
+			Event:     eventTest,
+			Timestamp: time.Now().UTC().Format(time.RFC3339),
+			Entry:     *entry,
+		})
+		httpJSON(w, http.StatusOK, results)
+	})
+
+	limiter := newHookLimiter()
+	mux.HandleFunc("/hooks/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/hooks/")
+		entry, err := store.Get(name)
+		if err != nil || entry.Hook == nil {
+			httpError(w, http.StatusNotFound, "hook "+name+" not found")
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, hookMaxBody))
+		if err != nil {
+			httpError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("body is larger than %d bytes", hookMaxBody))
+			return
+		}
+		if !authorizeHook(r, body, entry.Hook.Secret) {
+			fmt.Fprintf(defaultStderr, "cron %s: rejected hook call from %s\n", name, remoteIP(r))
+			httpError(w, http.StatusUnauthorized, "invalid token or signature")
+			return
+		}
+		if ok, wait := limiter.allow(name, entry.Hook.Rate, time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			httpError(w, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+		if entry.State != "active" {
+			httpError(w, http.StatusConflict, "task "+name+" is paused")
+			return
+		}
+
+		runID, err := scheduler.Hook(*entry, &hookInput{
+			Body:     string(body),
+			Query:    r.URL.RawQuery,
+			Caller:   hookCaller(r),
+			SourceIP: remoteIP(r),
+		})
+		if err != nil {
+			httpError(w, errorStatus(err, http.StatusConflict), err.Error())
+			return
+		}
+		httpJSON(w, http.StatusAccepted, map[string]string{"name": name, "runId": runID, "status": "QUEUED"})
+	})
+
+	mux.HandleFunc("/running", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		httpJSON(w, http.StatusOK, scheduler.Running())
+	})
+
+	mux.HandleFunc("/run", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
 		name := r.URL.Query().Get("name")
 		if name == "" {
 			httpError(w, http.StatusBadRequest, "name is required")
 			return
 		}
-		limitStr := r.URL.Query().Get("limit")
-		limit := 10
-		if limitStr != "" {
-			if n, err := strconv.Atoi(limitStr); err == nil && n > 0 {
-				limit = n
+
+		runID, err := service.run(r, name)
+		if err != nil {
+			httpError(w, errorStatus(err, http.StatusNotFound), err.Error())
+			return
+		}
+		httpJSON(w, http.StatusAccepted, map[string]string{"name": name, "runId": runID, "status": "QUEUED"})
+	})
+
+	mux.HandleFunc("/kill", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		id := r.URL.Query().Get("run")
+		if id == "" {
+			httpError(w, http.StatusBadRequest, "run is required")
+			return
+		}
+
+		run, err := service.kill(r, id)
+		if err != nil {
+			httpError(w, errorStatus(err, http.StatusNotFound), err.Error())
+			return
+		}
+
+		httpJSON(w, http.StatusOK, map[string]string{"id": run.ID, "name": run.Name, "status": "CANCELLING"})
+	})
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		report := checkHealth(store, scheduler, started)
+		status := http.StatusOK
+		if time.Duration(report.LastTickAgeMs)*time.Millisecond > maxTickAge {
+			status = http.StatusServiceUnavailable
+		}
+		httpJSON(w, status, report)
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		report := checkHealth(store, scheduler, started)
+		status := http.StatusOK
+		if report.Status != "OK" {
+			status = http.StatusServiceUnavailable
+		}
+		httpJSON(w, status, report)
+	})
+
+	auth := &apiAuth{tokens: NewTokenStore(absDir), mtls: tlsClientCA != ""}
+	auth.clientRoles, err = parseClientRoles(tlsClientRoles)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	if enabled, err := auth.tokens.Enabled(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load tokens: %v\n", err)
+		os.Exit(1)
+	} else if !enabled && !auth.mtls && bind != "none" && !isLoopback(bind) {
+		fmt.Fprintf(os.Stderr, "warning: listening on %s without tokens, anyone who can reach the port can run commands; see aux4 cron token create\n", bind)
+	}
+
+	var tlsConfig *tls.Config
+	if tlsCert != "" || tlsKey != "" {
+		if tlsCert == "" || tlsKey == "" {
+			fmt.Fprintln(os.Stderr, "tlsCert and tlsKey are required together")
+			os.Exit(1)
+		}
+		tlsConfig, err = serverTLSConfig(resolvePath(absDir, tlsCert), resolvePath(absDir, tlsKey), resolvePath(absDir, tlsClientCA))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid TLS settings: %v\n", err)
+			os.Exit(1)
+		}
+	} else if tlsClientCA != "" {
+		fmt.Fprintln(os.Stderr, "tlsClientCA requires tlsCert and tlsKey")
+		os.Exit(1)
+	}
+
+	// The API is served over TCP unless bind is "none", and over a Unix
+	// socket unless socket is "none"
+	var listeners []net.Listener
+	var addresses []string
+	if bind != "none" {
+		listener, err := net.Listen("tcp", net.JoinHostPort(bind, port))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "server error: %v\n", err)
+			os.Exit(1)
+		}
+		address := listener.Addr().String()
+		if tlsConfig != nil {
+			listener = tls.NewListener(listener, tlsConfig)
+			address = "https://" + address
+		}
+		listeners = append(listeners, listener)
+		addresses = append(addresses, address)
+	}
+	if socket != "none" {
+		path := defaultSocketPath(port)
+		if socket != "" {
+			path = resolvePath(absDir, socket)
+		}
+		mode, err := strconv.ParseUint(socketMode, 8, 32)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid socket mode: %s\n", socketMode)
+			os.Exit(1)
+		}
+		listener, err := listenSocket(path, os.FileMode(mode))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to listen on socket: %v\n", err)
+			os.Exit(1)
+		}
+		listeners = append(listeners, listener)
+		addresses = append(addresses, path)
+	}
+	if len(listeners) == 0 {
+		fmt.Fprintln(os.Stderr, "bind and socket cannot both be none")
+		os.Exit(1)
+	}
+
+	server := &http.Server{Handler: requireAuth(auth, mux), ConnContext: markSocketConn}
+	// Event streams never end on their own; close them so shutdown does not
+	// wait for them
+	server.RegisterOnShutdown(events.Close)
+	stopped := make(chan struct{})
+
+	var shutdownOnce sync.Once
+	var drain DrainResult
+	shutdown := func() DrainResult {
+		shutdownOnce.Do(func() {
+			fmt.Fprintln(os.Stderr, "\nshutting down...")
+			drain = scheduler.Drain(drainWait)
+			if err := store.FlushHistory(); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to flush history: %v\n", err)
 			}
+			os.Remove(pidFile)
+			fmt.Fprintf(os.Stderr, "drained: %d completed, %d cancelled, %d dropped\n", drain.Completed, drain.Cancelled, drain.Dropped)
+
+			// Let in-flight API requests, including a /shutdown call, finish
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				server.Shutdown(ctx)
+				close(stopped)
+			}()
+		})
+		return drain
+	}
+
+	mux.HandleFunc("/shutdown", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
 		}
-		history := store.GetHistory(name, limit)
-		httpJSON(w, http.StatusOK, history)
+		audit.RecordRequest(r, auditShutdown, "", nil, nil)
+		httpJSON(w, http.StatusOK, shutdown())
 	})
 
 	pidFile = pidFilePath(port)
@@ -229,31 +749,92 @@ func startServer(args []string) {
 
 	// Start scheduling all active entries
 	scheduler.Start()
+	if scheduler.tracker != nil {
+		scheduler.tracker.Resume(store)
+	}
 
-	addr := fmt.Sprintf(":%s", port)
-	fmt.Fprintf(os.Stderr, "cron scheduler started on port %s\n", port)
-
-	server := &http.Server{Addr: addr, Handler: mux}
+	fmt.Fprintf(os.Stderr, "cron scheduler started on %s\n", strings.Join(addresses, " and "))
 
 	go func() {
 		sigCh := make(chan os.Signal, 1)
 		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 		<-sigCh
-		fmt.Fprintln(os.Stderr, "\nshutting down...")
-		scheduler.Stop()
-		os.Remove(pidFile)
-		server.Close()
+		shutdown()
 	}()
 
-	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+	go func() {
+		hupCh := make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		for range hupCh {
+			reload("SIGHUP")
+		}
+	}()
+
+	if watchEvery > 0 {
+		go watchFile(store.cronFilePath(), watchEvery, func() { reload("watch") })
+	}
+
+	served := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			served <- server.Serve(listener)
+		}(listener)
+	}
+	if err := <-served; err != http.ErrServerClosed {
 		os.Remove(pidFile)
 		fmt.Fprintf(os.Stderr, "server error: %v\n", err)
 		os.Exit(1)
 	}
+	<-stopped
+}
+
+// watchFile polls the file every interval and calls changed when its size
+// or modification time differ from the previous poll.
+func watchFile(path string, interval time.Duration, changed func()) {
+	var lastMod time.Time
+	var lastSize int64 = -1
+	if info, err := os.Stat(path); err == nil {
+		lastMod, lastSize = info.ModTime(), info.Size()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if info.ModTime().Equal(lastMod) && info.Size() == lastSize {
+			continue
+		}
+		lastMod, lastSize = info.ModTime(), info.Size()
+		changed()
+	}
 }
 
 func pidFilePath(port string) string {
-	return filepath.Join(os.TempDir(), fmt.Sprintf(".aux4-cron-%s.pid", port))
+	return filepath.Join(runtimeDir(), port+".pid")
+}
+
+// errorStatus returns the HTTP status carried by a store error, or fallback.
+func errorStatus(err error, fallback int) int {
+	var ce *cronError
+	if errors.As(err, &ce) && ce.status != 0 {
+		return ce.status
+	}
+	return fallback
+}
+
+// splitList splits a comma-separated query value, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
 func httpError(w http.ResponseWriter, status int, message string) {
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// socketEnv overrides the socket client commands connect to.
+const socketEnv = "AUX4_CRON_SOCKET"
+
+// runtimeDir is where the pid files and sockets of the current user live:
+// $XDG_RUNTIME_DIR/aux4-cron, else a private directory in the temp dir.
+func runtimeDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "aux4-cron")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("aux4-cron-%d", os.Getuid()))
+}
+
+// ensureRuntimeDir creates the runtime directory and checks that no other
+// user can use it.
+func ensureRuntimeDir() error {
+	dir := runtimeDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return checkPrivateDir(dir)
+}
+
+func defaultSocketPath(port string) string {
+	return filepath.Join(runtimeDir(), port+".sock")
+}
+
+// listenSocket listens on a Unix socket with the given mode: 0600 lets only
+// the owner connect, 0660 the group too. A socket left behind by a
+// scheduler that died is replaced.
+func listenSocket(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+type socketConnKey struct{}
+
+// markSocketConn tags the requests of connections made through the socket,
+// whose access is already checked by its file permissions.
+func markSocketConn(ctx context.Context, conn net.Conn) context.Context {
+	if _, ok := conn.(*net.UnixConn); ok {
+		return context.WithValue(ctx, socketConnKey{}, true)
+	}
+	return ctx
+}
+
+func fromSocket(r *http.Request) bool {
+	local, _ := r.Context().Value(socketConnKey{}).(bool)
+	return local
+}
+
+// clientSocket returns the socket client commands use to reach the
+// scheduler on port: $AUX4_CRON_SOCKET if set, else the scheduler's default
+// socket when it accepts connections. An empty path means TCP.
+func clientSocket(port string) string {
+	if path := os.Getenv(socketEnv); path != "" {
+		return path
+	}
+	path := defaultSocketPath(port)
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return ""
+	}
+	conn.Close()
+	return path
+}
+
+func socketClient(path string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", path)
+		},
+	}}
+}
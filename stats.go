@@ -0,0 +1,144 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+type EntryStats struct {
+	Name                string  `json:"name"`
+	Runs                int     `json:"runs"`
+	Successes           int     `json:"successes"`
+	Failures            int     `json:"failures"`
+	Cancelled           int     `json:"cancelled"`
+	Pending             int     `json:"pending"`
+	SuccessRate         float64 `json:"successRate"`
+	AvgDurationMs       int64   `json:"avgDurationMs"`
+	P95DurationMs       int64   `json:"p95DurationMs"`
+	LastSuccess         string  `json:"lastSuccess,omitempty"`
+	LastFailure         string  `json:"lastFailure,omitempty"`
+	LastStatus          string  `json:"lastStatus,omitempty"`
+	ConsecutiveFailures int     `json:"consecutiveFailures"`
+}
+
+type EntrySummary struct {
+	LastStatus          string `json:"lastStatus,omitempty"`
+	ConsecutiveFailures int    `json:"consecutiveFailures,omitempty"`
+}
+
+type entryView struct {
+	CronEntry
+	EntrySummary
+}
+
+func isFailureStatus(status string) bool {
+	return status == "FAILED" || status == "TIMEOUT"
+}
+
+// isPendingStatus reports whether a run has no final status yet: its job
+// is still tracked, or it is not tracked at all.
+func isPendingStatus(status string) bool {
+	return status == "TRIGGERED"
+}
+
+// Stats computes run statistics per entry from the history recorded at or
+// after since (all retained history when since is zero). Entries that are
+// still defined but have not run in the window are reported with zero runs.
+func (s *CronStore) Stats(name string, since time.Time) []EntryStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	byName := make(map[string]*EntryStats)
+	durations := make(map[string][]int64)
+
+	get := func(n string) *EntryStats {
+		st, ok := byName[n]
+		if !ok {
+			st = &EntryStats{Name: n}
+			byName[n] = st
+		}
+		return st
+	}
+
+	for _, e := range s.entries {
+		if name == "" || e.Name == name {
+			get(e.Name)
+		}
+	}
+
+	for _, h := range s.history {
+		if name != "" && h.Name != name {
+			continue
+		}
+		if !since.IsZero() {
+			ts, err := time.Parse(time.RFC3339, h.Timestamp)
+			if err != nil || ts.Before(since) {
+				continue
+			}
+		}
+
+		st := get(h.Name)
+		st.Runs++
+		st.LastStatus = h.Status
+		if isPendingStatus(h.Status) {
+			// Neither a success nor a failure until the job finished
+			st.Pending++
+		} else if h.Status == "CANCELLED" {
+			st.Cancelled++
+		} else if isFailureStatus(h.Status) {
+			st.Failures++
+			st.ConsecutiveFailures++
+			st.LastFailure = h.Timestamp
+		} else {
+			st.Successes++
+			st.ConsecutiveFailures = 0
+			st.LastSuccess = h.Timestamp
+		}
+		if h.DurationMs > 0 {
+			durations[h.Name] = append(durations[h.Name], h.DurationMs)
+		}
+	}
+
+	result := make([]EntryStats, 0, len(byName))
+	for n, st := range byName {
+		if finished := st.Runs - st.Pending; finished > 0 {
+			st.SuccessRate = float64(st.Successes) / float64(finished)
+		}
+		if d := durations[n]; len(d) > 0 {
+			sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+			var total int64
+			for _, v := range d {
+				total += v
+			}
+			st.AvgDurationMs = total / int64(len(d))
+			st.P95DurationMs = d[(len(d)*95+99)/100-1]
+		}
+		result = append(result, *st)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// Summaries returns the last status and current failure streak of every
+// entry that has history.
+func (s *CronStore) Summaries() map[string]EntrySummary {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make(map[string]EntrySummary)
+	for _, h := range s.history {
+		summary := result[h.Name]
+		summary.LastStatus = h.Status
+		if h.Status == "CANCELLED" || isPendingStatus(h.Status) {
+			// Cancelled and unfinished runs neither break nor extend a
+			// failure streak
+		} else if isFailureStatus(h.Status) {
+			summary.ConsecutiveFailures++
+		} else {
+			summary.ConsecutiveFailures = 0
+		}
+		result[h.Name] = summary
+	}
+	return result
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sourceWatch = "watch"
+
+	// watchPollInterval is how often watched paths are checked
+	watchPollInterval = time.Second
+	// defaultDebounce is how long files must stop changing before a watch
+	// entry fires
+	defaultDebounce = 2 * time.Second
+)
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// watchPattern returns the glob an entry watches. A directory watches the
+// files directly inside it; relative paths are relative to the cron
+// directory.
+func watchPattern(entry CronEntry, dir string) string {
+	pattern := resolvePath(dir, entry.Watch)
+	if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+		return filepath.Join(pattern, "*")
+	}
+	return pattern
+}
+
+// snapshotFiles returns the regular files matching pattern.
+func snapshotFiles(pattern string) map[string]fileStamp {
+	files := make(map[string]fileStamp)
+	matches, _ := filepath.Glob(pattern)
+	for _, path := range matches {
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		files[path] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+	}
+	return files
+}
+
+// runWatch fires the entry when files matching its watch pattern are
+// created or modified. Changes are collected until the files have been
+// quiet for the debounce period, and fires are at least minInterval apart.
+// Files present when watching starts do not fire.
+func (s *Scheduler) runWatch(entry CronEntry, max int, stop chan struct{}) {
+	debounce := defaultDebounce
+	if entry.Debounce != "" {
+		debounce, _ = parseInterval(entry.Debounce)
+	}
+	var minInterval time.Duration
+	if entry.MinInterval != "" {
+		minInterval, _ = parseInterval(entry.MinInterval)
+	}
+
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+
+	seen := snapshotFiles(watchPattern(entry, s.store.dir))
+	pending := make(map[string]bool)
+	var lastChange, lastFire time.Time
+	count := 0
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			// The pattern is resolved again in case a watched directory
+			// was created since
+			current := snapshotFiles(watchPattern(entry, s.store.dir))
+			for path, stamp := range current {
+				if old, ok := seen[path]; !ok || old != stamp {
+					pending[path] = true
+					lastChange = now
+				}
+			}
+			seen = current
+
+			if len(pending) == 0 || now.Sub(lastChange) < debounce {
+				continue
+			}
+			if !lastFire.IsZero() && now.Sub(lastFire) < minInterval {
+				continue
+			}
+			// Keep collecting while the previous run is going rather than
+			// reporting the fire as missed
+			if s.busy(entry.Name) {
+				continue
+			}
+
+			files := make([]string, 0, len(pending))
+			for path := range pending {
+				files = append(files, path)
+			}
+			sort.Strings(files)
+			pending = make(map[string]bool)
+			lastFire = now
+
+			last := max > 0 && count+1 >= max
+			if !s.enqueue(runRequest{entry: entry, planned: now, source: sourceWatch, files: files, last: last}) {
+				continue
+			}
+			count++
+			if last {
+				return
+			}
+		}
+	}
+}
+
+// busy reports whether a run of the entry is queued or going.
+func (s *Scheduler) busy(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.inFlight[name]
+	return ok
+}
+
+// filesEnviron returns the variables passing the triggering files to the
+// command: CRON_FILE is the first, CRON_FILES all of them, one per line.
+func filesEnviron(files []string) []string {
+	if len(files) == 0 {
+		return nil
+	}
+	return []string{
+		"CRON_FILE=" + files[0],
+		"CRON_FILES=" + strings.Join(files, "\n"),
+	}
+}